@@ -232,14 +232,10 @@ func (d *peerMsgHandler) proposeRaftCommand(msg *raft_cmdpb.RaftCmdRequest, cb *
 	pro.cb = cb
 	pro.term = d.Term()
 	pro.index = d.nextProposalIndex()
-	for {
-		err := d.peer.RaftGroup.Propose(data)
-		if err == nil {
-			break
-		}
-		if err == raft.ErrProposalDropped {
-			continue
-		}
+	if err := d.peer.RaftGroup.Propose(data); err != nil {
+		// retrying here can't succeed, raft state doesn't change until we return
+		cb.Done(ErrResp(err))
+		return
 	}
 	d.proposals = append(d.proposals, &pro)
 }
@@ -308,11 +308,28 @@ func ClearMeta(engines *engine_util.Engines, kvWB, raftWB *engine_util.WriteBatc
 // never be committed
 func (ps *PeerStorage) Append(entries []eraftpb.Entry, raftWB *engine_util.WriteBatch) error {
 	// Your Code Here (2B).
+	if len(entries) == 0 {
+		return nil
+	}
+	first, _ := ps.FirstIndex()
+	last := entries[len(entries)-1].Index
+	if last < first {
+		return nil
+	}
+	// the compacted ones are in the snapshot already
+	if entries[0].Index < first {
+		entries = entries[first-entries[0].Index:]
+	}
 	for i := range entries {
 		mustNil(raftWB.SetMeta(meta.RaftLogKey(ps.region.Id, entries[i].Index), &entries[i]))
 	}
-	ps.raftState.LastIndex = max(entries[len(entries)-1].Index, ps.raftState.LastIndex)
-	ps.raftState.LastTerm = max(entries[len(entries)-1].Index, ps.raftState.LastTerm)
+	// the entries replaced a conflicting tail, drop what they don't overwrite
+	// so it doesn't come back on restart
+	for i := last + 1; i <= ps.raftState.LastIndex; i++ {
+		raftWB.DeleteMeta(meta.RaftLogKey(ps.region.Id, i))
+	}
+	ps.raftState.LastIndex = last
+	ps.raftState.LastTerm = entries[len(entries)-1].Term
 	log.Warnf("%v append raft lastIndex: %d LastTerm: %d", ps.Tag, ps.raftState.LastIndex, ps.raftState.LastTerm)
 	return nil
 }
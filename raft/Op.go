@@ -1,8 +1,10 @@
 package raft
 
 import (
+	"fmt"
 	"github.com/pingcap-incubator/tinykv/log"
 	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
+	"time"
 )
 
 type stepFunc func(r *Raft, m pb.Message) error
@@ -10,14 +12,37 @@ type stepFunc func(r *Raft, m pb.Message) error
 // Step the entrance of handle message, see `MessageType`
 // on `eraftpb.proto` for what msgs should be handled
 func (r *Raft) Step(m pb.Message) error {
+	if r.observer != nil {
+		start := time.Now()
+		defer func() { r.observer.OnStepDuration(m.MsgType, time.Since(start)) }()
+	}
 	log.Infof("%s receive msg: %s", r.info(), MessageStr(r, m))
 
 	switch {
 	case m.Term == 0: //local
 	case r.Term > m.Term: // 过时的
 		log.Debug("out dated")
+		if m.MsgType == pb.MessageType_MsgRequestVote {
+			// tell the stale candidate our term
+			r.send(r.NewRespVoteMsg(m.From, true))
+		} else if r.checkQuorum && (m.MsgType == pb.MessageType_MsgAppend || m.MsgType == pb.MessageType_MsgHeartbeat) {
+			// we may have gone up in term campaigning while the cluster
+			// ignored us within its lease. Answer with our term so the
+			// leader steps down and we can rejoin through a new election.
+			r.send(r.NewRespAppendMsg(m.From, 0, false))
+		}
 		return nil
 	case r.Term < m.Term:
+		// the leader's own transferee campaigns at its request, it's not
+		// a disruptive candidate
+		transfer := r.State == StateLeader && m.From == r.leadTransferee
+		if m.MsgType == pb.MessageType_MsgRequestVote && r.checkQuorum && !transfer &&
+			r.Lead != None && r.electionElapsed < r.electionTimeout {
+			// we heard from a valid leader recently, don't let a disruptive
+			// candidate bump our term.
+			log.Infof("%s ignore vote from %x at term %d, lease is not expired", r.info(), m.From, m.Term)
+			return nil
+		}
 		if m.MsgType == pb.MessageType_MsgAppend || m.MsgType == pb.MessageType_MsgHeartbeat || m.MsgType == pb.MessageType_MsgSnapshot {
 			r.becomeFollower(m.Term, m.From)
 		} else {
@@ -43,17 +68,22 @@ func (r *Raft) Step(m pb.Message) error {
 	case pb.MessageType_MsgSnapshot:
 		r.handleSnapshot(m)
 	case pb.MessageType_MsgBeat:
+		// local, only a leader has heartbeats to send. A heartbeat from the
+		// leader is a MsgHeartbeat, handled by the state's step function.
 		if r.State == StateLeader {
 			r.bckstHeart()
 		}
 
 	default:
-		err := r.step(r, m)
-		if err != nil {
-			log.Errorf("")
+		if err := r.step(r, m); err != nil {
+			log.Debugf("%s step %s: %v", r.info(), MessageStr(r, m), err)
+			return err
 		}
 	}
 	// Your Code Here (2A).
+	if r.strictSafety {
+		r.assertConfigConsistent()
+	}
 	return nil
 }
 func stepFollower(r *Raft, m pb.Message) error {
@@ -62,17 +92,43 @@ func stepFollower(r *Raft, m pb.Message) error {
 	if r.State != StateFollower {
 		log.Panicf("%s", r.info())
 	}
-	r.becomeFollower(m.Term, m.From)
 	switch m.MsgType {
 	case pb.MessageType_MsgPropose:
 		return ErrProposalDropped
 	case pb.MessageType_MsgHeartbeat:
+		if r.Lead != None && r.Lead != m.From {
+			return r.duplicateLeader(m)
+		}
 		r.becomeFollower(m.Term, m.From)
 		r.handleHeartbeat(m)
 	case pb.MessageType_MsgAppend:
+		if r.Lead != None && r.Lead != m.From {
+			return r.duplicateLeader(m)
+		}
 		r.becomeFollower(m.Term, m.From)
 		r.handleAppendEntries(m)
-
+	case pb.MessageType_MsgAppendResponse, pb.MessageType_MsgHeartbeatResponse:
+		// a response to a leader we used to be, the peer's progress is
+		// rebuilt if we become leader again, so it's safe to drop.
+		log.Debugf("%s ignore stray %s from %d", r.info(), m.MsgType, m.From)
+	case pb.MessageType_MsgTransferLeader:
+		// m.From is the transferee, forward it as is to the leader
+		if r.Lead == None {
+			log.Infof("%s no leader at term %d; dropping leader transfer msg", r.info(), r.Term)
+			return nil
+		}
+		m.To = r.Lead
+		r.send(m)
+	case pb.MessageType_MsgTimeoutNow:
+		// sent too early we'd campaign with a log behind the leader's, let
+		// the leader keep catching us up and hand over later
+		if last := r.RaftLog.LastLog(); last.Term < m.LogTerm || last.Term == m.LogTerm && last.Index < m.Index {
+			log.Infof("%s ignore MsgTimeoutNow from %d, log {%d:%d} behind the leader's {%d:%d}", r.info(), m.From, last.Term, last.Index, m.LogTerm, m.Index)
+			return nil
+		}
+		// the leader is handing over to us, don't wait for the election timeout
+		log.Infof("%s received MsgTimeoutNow from %d, start a new election", r.info(), m.From)
+		r.hup()
 	}
 	return nil
 }
@@ -85,13 +141,16 @@ func stepCandidate(r *Raft, m pb.Message) error {
 	case pb.MessageType_MsgPropose:
 		return ErrProposalDropped
 
-	case pb.MessageType_MsgBeat:
+	case pb.MessageType_MsgHeartbeat:
 		r.becomeFollower(m.Term, m.From)
 		r.handleHeartbeat(m)
 	case pb.MessageType_MsgAppend:
 		r.becomeFollower(m.Term, m.From)
 		r.handleAppendEntries(m)
 
+	case pb.MessageType_MsgAppendResponse, pb.MessageType_MsgHeartbeatResponse:
+		log.Debugf("%s ignore stray %s from %d", r.info(), m.MsgType, m.From)
+
 	case pb.MessageType_MsgRequestVoteResponse:
 		gr, rj, res := r.poll(m.From, m.MsgType, !m.Reject) //Reject = true stand not vote
 		log.Infof("%s has received %s %d votes and %d vote rejections result: %v", r.info(), MessageStr(r, m), gr, rj, res)
@@ -118,36 +177,129 @@ func stepLeader(r *Raft, m pb.Message) error {
 
 	switch m.MsgType {
 	case pb.MessageType_MsgPropose:
-		r.handleProse(m)
-	case pb.MessageType_MsgBeat:
-		r.Visit(func(idx int, to uint64) {
-			r.sendHeartbeat(to)
-		}, false)
+		return r.handleProse(m)
 	case pb.MessageType_MsgAppendResponse:
 		// 1. handle reject
 		log.Debugf("get from %d reject: %v", m.From, m.Reject)
 		pr := r.Prs[m.From]
+		if pr == nil {
+			log.Debugf("%s ignore append response from removed node %d", r.info(), m.From)
+			return nil
+		}
+		pr.RecentActive = true
+		// an answer to the probe we're waiting on, not one delayed from before
+		probeAnswer := pr.Probe && pr.Inflight
+		pr.Inflight = false
+		delete(r.retriesLeft, m.From)
+		pr.Commit = max(pr.Commit, m.Commit)
+		oldMatch := pr.Match
+		lostLog := false
+		if m.Reject {
+			// the peer answered, the snapshot is given up if it was lost
+			pr.PendingSnapshot = 0
+		}
 		if m.Reject == false {
-			pr.Next = max(pr.Next, m.Index+1)
-			pr.Match = max(pr.Match, m.Index)
+			resume := pr.Probe
+			pr.Probe = false
+			pr.mayUpdateIndex(m.Index)
+			// the snapshot is installed, what came after it is still to send
+			if pr.PendingSnapshot != 0 && pr.Match >= pr.PendingSnapshot {
+				pr.PendingSnapshot = 0
+				resume = resume || pr.Match < r.RaftLog.LastIndex()
+			}
 			log.Infof("%s has received %s index: %d", r.info(), MessageStr(r, m), m.Index)
 			// 2. update commit
-			oldCommit := r.RaftLog.committed
-			newCommit := r.updateCommit()
-			if oldCommit < newCommit {
-				log.Debugf("get commit :%d", newCommit)
+			if !r.benchMode && r.maybeCommit() {
+				log.Debugf("get commit :%d", r.RaftLog.committed)
 				r.bcastAppend(false)
+				resume = false
+			}
+			if m.From == r.leadTransferee && pr.Match == r.RaftLog.LastIndex() {
+				log.Infof("%s sent MsgTimeoutNow to %d after it caught up", r.info(), m.From)
+				r.send(r.NewTimeoutNowMsg(m.From))
+			}
+			// the probe found the match or the snapshot got through, now send
+			// the entries if the commit broadcast didn't already
+			if resume {
+				r.sendAppend(m.From)
 			}
 
+		} else if pr.maybeDecrTo() {
+			log.Infof("%s %d reject, next back to %d", r.info(), m.From, pr.Next)
+			// retry from the earlier entry right away, a follower with a tail
+			// the leader doesn't have converges one entry per round trip
+			r.sendAppend(m.From)
+		} else if m.Index != 0 && m.Index == pr.Match && m.Index == pr.Next-1 && !probeAnswer {
+			// a reject of the entry at its Match may have been delayed past
+			// the ack, probe it before dropping what the peer acked
+			log.Infof("%s %d rejected its match %d, probe it", r.info(), m.From, pr.Match)
+			pr.Probe = true
+			r.sendAppend(m.From)
+		} else if m.Index != 0 && m.Index == pr.Match && m.Index == pr.Next-1 {
+			// it rejected our probe of its Match, so it lost entries it had
+			// acked, e.g. it came back from a crash with an older disk. Start
+			// over from its commit, which it still has, and probe from there.
+			log.Warningf("%s %d lost its log after match %d, restart from its commit %d", r.info(), m.From, pr.Match, m.Commit)
+			pr.Match = min(m.Commit, pr.Match)
+			pr.Next = pr.Match + 1
+			lostLog = true
+			r.sendAppend(m.From)
 		} else {
-			pr.Next--
-			log.Infof("reject")
+			log.Debugf("%s ignore stale reject from %d, match %d", r.info(), m.From, pr.Match)
+		}
+		// Match 在一个任期内只能前进, unless the peer lost its log: what it
+		// acked is gone and it has to be replicated again
+		if pr.Match < oldMatch && !lostLog {
+			log.Panicf("%s match of %d regressed from %d to %d", r.info(), m.From, oldMatch, pr.Match)
 		}
 
 	case pb.MessageType_MsgHeartbeatResponse:
-		// 1. 追赶日志
-		r.sendAppend(m.From)
+		pr := r.Prs[m.From]
+		if pr == nil {
+			return nil
+		}
+		pr.RecentActive = true
+		pr.Inflight = false
+		delete(r.retriesLeft, m.From)
+		pr.Commit = max(pr.Commit, m.Commit)
+		if pr.PendingSnapshot != 0 && m.Commit >= pr.PendingSnapshot {
+			// the ack of the snapshot was lost, but the commit shows the
+			// peer has it, and what it committed matches our log
+			pr.PendingSnapshot = 0
+			pr.mayUpdateIndex(m.Commit)
+		}
+		if m.Index > pr.ReadRound {
+			pr.ReadRound = m.Index
+			r.releasePendingReads()
+		}
+		// 1. 追赶日志, this also resends the no-op if the first broadcast
+		// was lost, so it commits without client traffic
+		if pr.Match < r.RaftLog.LastIndex() {
+			r.sendAppend(m.From)
+		} else if pr.Commit < min(pr.Match, r.RaftLog.committed) {
+			// the append that carried the commit was lost, send it again
+			// (it has no entries left to carry)
+			r.sendAppend(m.From)
+		}
+	case pb.MessageType_MsgTransferLeader:
+		r.handleTransferLeader(m)
+	case pb.MessageType_MsgAppend, pb.MessageType_MsgHeartbeat:
+		// other terms were handled in Step, this is a second leader in our term
+		return r.duplicateLeader(m)
 	}
 
 	return nil
 }
+
+// duplicateLeader reports m, an append or heartbeat from a leader of our term
+// other than the one we know of. Raft elects at most one leader per term, so
+// this is a safety violation and m is not applied.
+func (r *Raft) duplicateLeader(m pb.Message) error {
+	reason := fmt.Sprintf("%s received %s from %d, another leader at term %d", r.info(), m.MsgType, m.From, m.Term)
+	if r.strictSafety {
+		r.abort(reason)
+	} else {
+		log.Errorf("%s", reason)
+	}
+	return ErrDuplicateLeader
+}
@@ -0,0 +1,134 @@
+package raft
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
+)
+
+// raftState is a checkpoint of the state of a Raft, so a simulation can save
+// a node and replay it later. It shares nothing with the node it was taken
+// from and can be round-tripped through encoding/json.
+type raftState struct {
+	Term, Vote, Lead uint64
+	State            StateType
+	Votes            map[uint64]bool
+
+	Committed, Applied, Stabled, Start uint64
+	Entries                            []pb.Entry
+
+	Prs map[uint64]Progress
+}
+
+// snapshotState takes a deep copy of the state of r.
+func (r *Raft) snapshotState() raftState {
+	s := raftState{
+		Term:      r.Term,
+		Vote:      r.Vote,
+		Lead:      r.Lead,
+		State:     r.State,
+		Votes:     make(map[uint64]bool, len(r.votes)),
+		Committed: r.RaftLog.committed,
+		Applied:   r.RaftLog.applied,
+		Stabled:   r.RaftLog.stabled,
+		Start:     r.RaftLog.start,
+		Entries:   make([]pb.Entry, len(r.RaftLog.entries)),
+		Prs:       make(map[uint64]Progress, len(r.Prs)),
+	}
+	for id, v := range r.votes {
+		s.Votes[id] = v
+	}
+	for i, e := range r.RaftLog.entries {
+		s.Entries[i] = copyEntry(e)
+	}
+	for id, pr := range r.Prs {
+		s.Prs[id] = *pr
+	}
+	return s
+}
+
+// restoreState puts r back in the checkpointed state, r keeps its storage,
+// config and clocks.
+func (r *Raft) restoreState(s raftState) {
+	r.Term, r.Vote, r.Lead, r.State = s.Term, s.Vote, s.Lead, s.State
+	switch s.State {
+	case StateFollower:
+		r.step = stepFollower
+	case StateCandidate:
+		r.step = stepCandidate
+	case StateLeader:
+		r.step = stepLeader
+	}
+	r.votes = make(map[uint64]bool, len(s.Votes))
+	for id, v := range s.Votes {
+		r.votes[id] = v
+	}
+	l := r.RaftLog
+	l.committed, l.applied, l.stabled, l.start = s.Committed, s.Applied, s.Stabled, s.Start
+	l.entries = make([]pb.Entry, len(s.Entries))
+	for i, e := range s.Entries {
+		l.entries[i] = copyEntry(e)
+	}
+	l.dataSize = entsDataSize(l.entries[1:])
+	r.Prs = make(map[uint64]*Progress, len(s.Prs))
+	r.peers = make([]uint64, 0, len(s.Prs))
+	for id, pr := range s.Prs {
+		pr := pr
+		r.Prs[id] = &pr
+		r.peers = append(r.peers, id)
+	}
+	// peers is in map order now, keep the replay deterministic
+	sort.Slice(r.peers, func(i, j int) bool { return r.peers[i] < r.peers[j] })
+}
+
+func copyEntry(e pb.Entry) pb.Entry {
+	return pb.Entry{EntryType: e.EntryType, Term: e.Term, Index: e.Index, Data: append([]byte(nil), e.Data...)}
+}
+
+// TestRaftStateRoundTrip2AA tests that a checkpoint of a candidate in the
+// middle of an election restores to the same state, through JSON, and that it
+// isn't changed when the node moves on.
+func TestRaftStateRoundTrip2AA(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Append([]pb.Entry{{Term: 1, Index: 1, Data: []byte("a")}, {Term: 1, Index: 2, Data: []byte("b")}})
+	storage.SetHardState(pb.HardState{Term: 1, Commit: 1})
+	r := newTestRaft(1, []uint64{1, 2, 3, 4, 5}, 10, 1, storage)
+	r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgRequestVoteResponse})
+	r.readMessages()
+
+	s := r.snapshotState()
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded raftState
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	// move on, the checkpoint must not follow
+	r.Step(pb.Message{From: 3, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgRequestVoteResponse})
+	if r.State != StateLeader {
+		t.Fatalf("state = %v, want %v", r.State, StateLeader)
+	}
+	r.RaftLog.entries[1].Data[0] = 'x'
+	if s.State != StateCandidate || len(s.Votes) != 2 || string(s.Entries[1].Data) != "a" {
+		t.Fatalf("checkpoint changed with the node: %+v", s)
+	}
+
+	restored := newTestRaft(1, []uint64{1, 2, 3, 4, 5}, 10, 1, NewMemoryStorage())
+	restored.restoreState(decoded)
+	if g := restored.snapshotState(); !reflect.DeepEqual(g, s) {
+		t.Errorf("restored = %+v, want %+v", g, s)
+	}
+
+	// the restored candidate wins the same way
+	restored.Step(pb.Message{From: 3, To: 1, Term: restored.Term, MsgType: pb.MessageType_MsgRequestVoteResponse})
+	if restored.State != StateLeader {
+		t.Errorf("restored state = %v, want %v", restored.State, StateLeader)
+	}
+}
@@ -0,0 +1,66 @@
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
+)
+
+// ErrChecksumMismatch is returned when an entry loaded from storage doesn't
+// match the checksum recorded when it was appended.
+var ErrChecksumMismatch = errors.New("raft: entry checksum mismatch")
+
+// ErrNoChecksums is returned when entries are verified against a storage
+// that doesn't record checksums.
+var ErrNoChecksums = errors.New("raft: verify entries needs a storage that keeps checksums")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumStorage is implemented by a Storage that records a checksum for
+// every entry it appends, so corruption can be detected on load.
+// MemoryStorage does once EnableChecksums is called.
+// (Used with Config.VerifyEntries)
+type ChecksumStorage interface {
+	Storage
+	// Checksums returns the checksums of the entries in the range [lo,hi).
+	Checksums(lo, hi uint64) ([]uint32, error)
+}
+
+// entryChecksum is the CRC32 of the entry's term, index, type and data.
+func entryChecksum(e *pb.Entry) uint32 {
+	var buf [20]byte
+	binary.BigEndian.PutUint64(buf[0:], e.Term)
+	binary.BigEndian.PutUint64(buf[8:], e.Index)
+	binary.BigEndian.PutUint32(buf[16:], uint32(e.EntryType))
+	crc := crc32.Update(0, crcTable, buf[:])
+	return crc32.Update(crc, crcTable, e.Data)
+}
+
+// verifyEntries checks the entries loaded from storage against the checksums
+// the storage recorded for them.
+func (l *RaftLog) verifyEntries() error {
+	cs, ok := l.storage.(ChecksumStorage)
+	if !ok {
+		return ErrNoChecksums
+	}
+	ents := l.entries[1:]
+	if len(ents) == 0 {
+		return nil
+	}
+	sums, err := cs.Checksums(ents[0].Index, ents[len(ents)-1].Index+1)
+	if err != nil {
+		return err
+	}
+	if len(sums) != len(ents) {
+		return fmt.Errorf("raft: got %d checksums for %d entries", len(sums), len(ents))
+	}
+	for i := range ents {
+		if entryChecksum(&ents[i]) != sums[i] {
+			return fmt.Errorf("%w: entry %d", ErrChecksumMismatch, ents[i].Index)
+		}
+	}
+	return nil
+}
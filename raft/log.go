@@ -55,36 +55,79 @@ type RaftLog struct {
 
 	// Your Data Here (2A).
 	start uint64
+
+	// snapshotInProgress is set while the application is building a snapshot
+	// requested since the last Advance, compaction waits so the entries it
+	// reads up to applied stay in place.
+	snapshotInProgress bool
+
+	// applyUnstable lets committed entries be applied before they are stabled.
+	// (Used with Config.AsyncApply)
+	applyUnstable bool
+
+	// retainEntries is how many entries below applied compaction keeps.
+	// (Used with Config.CompactionRetainEntries)
+	retainEntries uint64
+
+	// dataSize is the size of the data of the entries in memory.
+	// (Used with Config.MaxLogSize)
+	dataSize uint64
+
+	// truncated is the range of stabled entries replaced by a conflicting
+	// append since the last Ready, see Ready.Truncated.
+	truncated LogRange
+
+	// onCommitted is called with the new committed index when it advances.
+	// (Used with Config.OnCommitted)
+	onCommitted func(index uint64)
 }
 
 // newLog returns log using the given storage. It recovers the log
 // to the state that it just commits and applies the latest snapshot.
 func newLog(storage Storage) *RaftLog {
 	// Your Code Here (2A).
-	log := &RaftLog{}
-	log.storage = storage
-	state, _, err := log.storage.InitialState()
-	log.committed = state.Commit
+	l := &RaftLog{}
+	l.storage = storage
+	state, _, err := l.storage.InitialState()
+	l.committed = state.Commit
 	mustBeNil(err)
 	start, err := storage.FirstIndex()
-	log.start = start - 1
-	log.applied = log.start
+	l.start = start - 1
+	l.applied = l.start
 	mustBeNil(err)
 	LastIndex, err := storage.LastIndex()
-	log.stabled = LastIndex
+	l.stabled = LastIndex
 	mustBeNil(err)
 
 	entries, err := storage.Entries(start, LastIndex+1)
 	mustBeNil(err)
 	//todo(judge start)
-	log.entries = make([]pb.Entry, 1) // contain start
-	log.entries[0].Index = log.start
-	log.entries[0].Term, err = storage.Term(log.start)
+	l.entries = make([]pb.Entry, 1) // contain start
+	l.entries[0].Index = l.start
+	l.entries[0].Term, err = storage.Term(l.start)
 	mustBeNil(err)
-	log.entries = append(log.entries, entries...)
+	l.entries = append(l.entries, entries...)
+	l.dataSize = entsDataSize(entries)
+
+	// the snapshot is committed even if the HardState wasn't saved after it,
+	// but a commit past the log means the storage lost entries
+	if l.committed > LastIndex {
+		log.Panicf("committed(%d) is out of range [snapshot(%d), lastIndex(%d)]", l.committed, l.start, LastIndex)
+	}
+	l.committed = max(l.committed, l.start)
+
+	fmt.Printf("newLog: %+v\n", l)
+	return l
+}
 
-	fmt.Printf("newLog: %+v\n", log)
-	return log
+// restoreApplied sets applied from Config.Applied on restart. newLog starts
+// applied at the snapshot, the configured value may only move it forward up
+// to committed, anything else means the application and raft disagree.
+func (l *RaftLog) restoreApplied(applied uint64) {
+	if applied < l.start || applied > l.committed {
+		log.Panicf("applied(%d) is out of range [snapshot(%d), committed(%d)]", applied, l.start, l.committed)
+	}
+	l.applied = applied
 }
 
 // We need to compact the log entries in some point of time like
@@ -92,6 +135,64 @@ func newLog(storage Storage) *RaftLog {
 // grow unlimitedly in memory
 func (l *RaftLog) maybeCompact() {
 	// Your Code Here (2C).
+	// applied is read once and the discard below uses this value only, so the
+	// application can't move it in between (RaftLog is not thread safe, the
+	// application advances applied through the same goroutine).
+	applied := l.applied
+	first, err := l.storage.FirstIndex()
+	mustBeNil(err)
+	if applied <= l.retainEntries || l.snapshotInProgress {
+		return
+	}
+	// only discard entries strictly below applied, and keep retainEntries of
+	// them for the followers that are a little behind
+	index := min(first-1, applied-1-l.retainEntries)
+	if index <= l.start {
+		return
+	}
+	l.compact(index, applied)
+}
+
+// forceCompact discards the entries in memory up to index regardless of the
+// storage and of CompactionRetainEntries, for an operator recovering memory.
+// index may be applied and stabled at most, with AsyncApply the entries
+// applied but not persisted yet must stay to reach the storage. ErrCompacted
+// is returned if it's already compacted.
+//
+// Followers that still need the entries get the storage's snapshot, which
+// must be at or past index: a MemoryStorage needs CreateSnapshot first, or the
+// leader sends its older snapshot over and over. A storage that builds the
+// snapshot of the applied state on demand, like PeerStorage, always is.
+func (l *RaftLog) forceCompact(index uint64) error {
+	if index > l.applied || index > l.stabled {
+		return fmt.Errorf("raft: can't compact to %d above applied %d or stabled %d", index, l.applied, l.stabled)
+	}
+	if index < l.First() {
+		return ErrCompacted
+	}
+	l.compact(index, l.applied)
+	return nil
+}
+
+// compact discards the entries up to index, index becomes the dummy entry.
+func (l *RaftLog) compact(index, applied uint64) {
+	if index > applied {
+		log.Panicf("compact(%d) would discard the unapplied entries after %d", index, applied)
+	}
+	ents := make([]pb.Entry, 1, l.LastIndex()-index+1)
+	ents[0].Index, ents[0].Term = index, l.entries[index-l.start].Term
+	l.dataSize -= entsDataSize(l.entries[1 : index-l.start+1])
+	l.entries = append(ents, l.entries[index-l.start+1:]...)
+	l.start = index
+}
+
+// entsDataSize is the size of the data of ents.
+func entsDataSize(ents []pb.Entry) uint64 {
+	var s uint64
+	for i := range ents {
+		s += uint64(len(ents[i].Data))
+	}
+	return s
 }
 
 // allEntries return all the entries not compacted.
@@ -102,30 +203,86 @@ func (l *RaftLog) allEntries() []pb.Entry {
 	return l.entries[1:]
 }
 
-// unstableEntries return all the unstable entries
+// unstableEntries return all the unstable entries, the ones after stabled.
+// Everything up to the snapshot is stable whatever stabled says, and nothing
+// is unstable if stabled is at or past the last index.
 func (l *RaftLog) unstableEntries() []pb.Entry {
-	if l.stabled == l.LastIndex() {
+	// Your Code Here (2A).
+	from := max(l.stabled, l.start) + 1
+	if from > l.LastIndex() {
 		return []pb.Entry{}
 	}
-	// Your Code Here (2A).
 	log.Debugf("unstableEntries: start: %d, stabled: %d, len: %d\n", l.start, l.stabled, len(l.entries))
-	return l.entries[l.stabled-l.start+1:]
+	return l.entries[from-l.start:]
 }
 
-// nextEnts returns all the committed but not applied entries
-func (l *RaftLog) nextEnts() (ents []pb.Entry) {
-	if l.applied == l.committed {
+// uncommittedEntries returns a copy of the entries in (committed, LastIndex],
+// e.g. for speculative execution. They are not durable decisions, a new
+// leader may truncate them, so results must only be confirmed once the
+// entries commit. The entries' Data is shared with the log and must not be
+// modified.
+func (l *RaftLog) uncommittedEntries() []pb.Entry {
+	if l.committed >= l.LastIndex() {
 		return []pb.Entry{}
 	}
+	ents := l.entries[l.committed-l.start+1:]
+	return append(make([]pb.Entry, 0, len(ents)), ents...)
+}
+
+// appliableIndex returns the last index that may be applied, the committed
+// index capped at stabled unless applyUnstable is set, so an entry applied
+// to the state machine can't be lost to a crash before it's persisted.
+func (l *RaftLog) appliableIndex() uint64 {
+	if l.applyUnstable {
+		return l.committed
+	}
+	return min(l.committed, l.stabled)
+}
+
+// isApplied reports whether the entry at index is committed and applied.
+func (l *RaftLog) isApplied(index uint64) bool {
+	return index <= l.applied
+}
 
+// nextEnts returns all the committed but not applied entries, up to the
+// appliableIndex
+func (l *RaftLog) nextEnts() (ents []pb.Entry) {
 	if l.applied > l.committed {
 		log.Panicf("applied(%d) > committed(%d)]", l.applied, l.committed)
 	}
-	ents = l.entries[l.applied-l.start+1 : l.committed-l.start+1]
+	hi := l.appliableIndex()
+	if l.applied >= hi {
+		return []pb.Entry{}
+	}
+	// the pending snapshot must be applied before any entry after it
+	if l.pendingSnapshot != nil {
+		return []pb.Entry{}
+	}
+	ents = l.entries[l.applied-l.start+1 : hi-l.start+1]
 	log.Errorf("nextEnts: %v", ents)
 	return
 }
 
+// forEachCommitted calls f on the committed but not applied entries in order,
+// the same ones as nextEnts, without building a slice. It stops early if f
+// returns false. Applied isn't moved, the caller does it once the entries are
+// applied. f must not modify or retain e.
+func (l *RaftLog) forEachCommitted(f func(e *pb.Entry) bool) {
+	// the pending snapshot must be applied before any entry after it
+	if l.pendingSnapshot != nil {
+		return
+	}
+	if l.applied > l.committed {
+		log.Panicf("applied(%d) > committed(%d)]", l.applied, l.committed)
+	}
+	// entries below the snapshot are gone, and the dummy entry is never visited
+	for i := max(l.applied, l.start) + 1; i <= l.appliableIndex(); i++ {
+		if !f(&l.entries[i-l.start]) {
+			return
+		}
+	}
+}
+
 // LastIndex return the last index of the log entries
 func (l *RaftLog) LastIndex() uint64 {
 	return l.LastLog().Index
@@ -155,8 +312,10 @@ func (l *RaftLog) LastLog() pb.Entry {
 
 // if not in [First,LastLogIndex] return nil
 func (l *RaftLog) entryAt(index uint64) (*pb.Entry, error) {
-	if index == l.start {
-		return &l.entries[0], nil
+	// fast path for the hot lookups during append, the offset wraps around
+	// below start so one comparison covers both bounds, the dummy included
+	if off := index - l.start; off < uint64(len(l.entries)) {
+		return &l.entries[off], nil
 	}
 
 	if index < l.First() { // is compact
@@ -171,6 +330,7 @@ func (l *RaftLog) entryAt(index uint64) (*pb.Entry, error) {
 }
 func (l *RaftLog) append(entries ...pb.Entry) uint64 {
 	l.entries = append(l.entries, entries...)
+	l.dataSize += entsDataSize(entries)
 	return l.LastIndex()
 }
 
@@ -207,35 +367,71 @@ func (l *RaftLog) IsConflict(index, term uint64) bool {
 // truncate index to end(include index)
 func (l *RaftLog) truncate(index uint64) {
 	log.Infof("truncate: %d", index)
+	if index <= l.stabled {
+		// the storage holds them, the application has to drop them
+		if l.truncated.Empty() {
+			l.truncated = LogRange{Lo: index, Hi: l.stabled}
+		} else {
+			l.truncated = LogRange{Lo: min(l.truncated.Lo, index), Hi: max(l.truncated.Hi, l.stabled)}
+		}
+	}
+	l.dataSize -= entsDataSize(l.entries[index-l.start:])
 	l.entries = l.entries[:index-l.start]
 	l.stabled = min(l.stabled, l.LastIndex())
 }
 
+// Stabled returns the index of the last entry persisted to storage.
+func (l *RaftLog) Stabled() uint64 {
+	return l.stabled
+}
+
 func (l *RaftLog) updateCommitIndex(commit uint64) {
-	if commit < l.committed {
+	l.commitTo(commit)
+}
+
+// commitTo moves committed forward to index, and tells onCommitted if it
+// moved. A commit index going back is ignored.
+func (l *RaftLog) commitTo(index uint64) {
+	if index <= l.committed {
 		return
 	}
-	l.committed = commit
+	l.committed = index
+	if l.onCommitted != nil {
+		l.onCommitted(index)
+	}
 }
 
 // cutDown cut down the log entries to (index,LastLogIndex]
 func (l *RaftLog) cutDown(index, term uint64) {
 	var cp []pb.Entry
-	if index > l.LastIndex() {
-		log.Warnf("cutDown: index(%d) > LastIndex(%d)", index, l.LastIndex())
+	if index >= l.LastIndex() {
+		log.Warnf("cutDown: index(%d) >= LastIndex(%d)", index, l.LastIndex())
 		cp = make([]pb.Entry, 1)
 	} else {
-		cp = make([]pb.Entry, l.LastIndex()-index-l.start+1)
+		// keep the dummy entry and (index,LastLogIndex]
+		cp = make([]pb.Entry, l.LastIndex()-index+1)
+		copy(cp[1:], l.entries[index-l.start+1:])
 		log.Infof("cut down: %d, %d, %d, %d", index, l.LastIndex(), len(l.entries), len(cp))
 	}
 	cp[0].Index, cp[0].Term = index, term
-	if index+1 < l.LastIndex() {
-		copy(cp[1:], l.entries[index+1:])
-	}
 	l.entries = cp
+	l.dataSize = entsDataSize(cp[1:])
 	l.start = index
 
-	l.committed = max(l.committed, index)
-	l.applied = max(l.applied, index)
 	l.stabled = max(l.stabled, index)
+	l.commitTo(index)
+}
+
+// stableSnapTo is called once the application confirmed that the pending
+// snapshot at index i was persisted and applied. Only then the log moves to
+// it, until then it keeps its bounds so nothing claims the snapshot is on
+// disk. It reports whether i was the pending snapshot.
+func (l *RaftLog) stableSnapTo(i uint64) bool {
+	if l.pendingSnapshot == nil || l.pendingSnapshot.Metadata.Index != i {
+		return false
+	}
+	l.cutDown(i, l.pendingSnapshot.Metadata.Term)
+	l.applied = max(l.applied, i)
+	l.pendingSnapshot = nil
+	return true
 }
@@ -0,0 +1,28 @@
+package raft
+
+import (
+	"testing"
+
+	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
+)
+
+// BenchmarkEntryAt looks up every entry of a 100k-entry log, as matching an
+// append does per entry.
+func BenchmarkEntryAt(b *testing.B) {
+	const n = 100000
+	ents := make([]pb.Entry, n)
+	for i := range ents {
+		ents[i] = pb.Entry{Term: 1, Index: uint64(i + 1), Data: []byte("somedata")}
+	}
+	storage := NewMemoryStorage()
+	storage.Append(ents)
+	l := newLog(storage)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index := uint64(i%n) + 1
+		if _, err := l.entryAt(index); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
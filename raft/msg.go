@@ -10,16 +10,37 @@ func (r *Raft) NewHeartbeatMsg(to uint64) pb.Message {
 	if r.State != StateLeader {
 		log.Panicf("you state %s not leader", r.info())
 	}
+	// only commit what the peer is known to have, its log past Match may
+	// still be an older leader's
+	var match uint64
+	if pr := r.Prs[to]; pr != nil {
+		match = pr.Match
+	}
 	return pb.Message{
 		MsgType: pb.MessageType_MsgHeartbeat,
 		To:      to,
-		Commit:  r.RaftLog.committed,
+		Index:   r.readRound,
+		Commit:  min(match, r.RaftLog.committed),
+	}
+}
+func (r *Raft) NewTimeoutNowMsg(to uint64) pb.Message {
+	if r.State != StateLeader {
+		log.Panicf("you state %s not leader", r.info())
+	}
+	// the transferee checks it caught up with our log
+	last := r.RaftLog.LastLog()
+	return pb.Message{
+		MsgType: pb.MessageType_MsgTimeoutNow,
+		To:      to,
+		LogTerm: last.Term,
+		Index:   last.Index,
 	}
 }
 func (r *Raft) NewRespHeartbeatMsg(to uint64) pb.Message {
 	return pb.Message{
 		MsgType: pb.MessageType_MsgHeartbeatResponse,
 		To:      to,
+		Commit:  r.RaftLog.committed,
 	}
 }
 
@@ -40,6 +61,7 @@ func (r *Raft) NewRespVoteMsg(to uint64, reject bool) pb.Message {
 		MsgType: pb.MessageType_MsgRequestVoteResponse,
 		To:      to,
 		From:    r.id,
+		Term:    r.Term, // a rejection may carry a higher term, so the candidate steps down
 		Reject:  reject,
 	}
 }
@@ -50,7 +72,7 @@ func (r *Raft) NewAppendMsg(to uint64) pb.Message {
 	}
 	pr, ok := r.Prs[to]
 	if !ok {
-		log.Panicf("don't have this node %d ?", pr)
+		log.Panicf("don't have this node %d ?", to)
 	}
 
 	prevLog, err := r.RaftLog.entryAt(pr.Next - 1)
@@ -63,6 +85,7 @@ func (r *Raft) NewAppendMsg(to uint64) pb.Message {
 			if err != nil {
 				if errors.Is(err, ErrSnapshotTemporarilyUnavailable) {
 					log.Errorf("%s send to %d {%d:%d} snapshot temporarily unavailable", r.info(), to, pr.Next, r.RaftLog.LastIndex())
+					r.RaftLog.snapshotInProgress = true
 					return r.NewHeartbeatMsg(to)
 				}
 				log.Panicf("%s send to %d {%d:%d} snapshot error %s", r.info(), to, pr.Next, r.RaftLog.LastIndex(), err)
@@ -78,13 +101,17 @@ func (r *Raft) NewAppendMsg(to uint64) pb.Message {
 	}
 	log.Infof("%s send log to %d {%d:%d}", r.info(), to, pr.Next, r.RaftLog.LastIndex())
 
+	var ents []*pb.Entry
+	if !pr.Probe {
+		ents = r.RaftLog.slice(pr.Next, r.RaftLog.LastIndex())
+	}
 	return pb.Message{
 		MsgType: pb.MessageType_MsgAppend,
 		To:      to,
 		Index:   prevLog.Index,
 		LogTerm: prevLog.Term,
 		Commit:  r.RaftLog.committed,
-		Entries: r.RaftLog.slice(pr.Next, r.RaftLog.LastIndex()),
+		Entries: ents,
 	}
 }
 func (r *Raft) NewRespAppendMsg(to, index uint64, reject bool) pb.Message {
@@ -93,5 +120,6 @@ func (r *Raft) NewRespAppendMsg(to, index uint64, reject bool) pb.Message {
 		To:      to,
 		Reject:  reject,
 		Index:   index,
+		Commit:  r.RaftLog.committed,
 	}
 }
@@ -0,0 +1,139 @@
+package raft
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
+)
+
+// sortMessages sorts msgs in place by (MsgType, To, From, Term, Index), so
+// tests can assert on the set of emitted messages regardless of the emission
+// order.
+func sortMessages(msgs []pb.Message) []pb.Message {
+	sort.SliceStable(msgs, func(i, j int) bool {
+		a, b := msgs[i], msgs[j]
+		if a.MsgType != b.MsgType {
+			return a.MsgType < b.MsgType
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.Term != b.Term {
+			return a.Term < b.Term
+		}
+		return a.Index < b.Index
+	})
+	return msgs
+}
+
+// stripMessage returns m without the volatile protobuf bookkeeping fields,
+// nil and empty Entries are treated the same.
+func stripMessage(m pb.Message) pb.Message {
+	sm := pb.Message{
+		MsgType: m.MsgType,
+		To:      m.To,
+		From:    m.From,
+		Term:    m.Term,
+		LogTerm: m.LogTerm,
+		Index:   m.Index,
+		Commit:  m.Commit,
+		Reject:  m.Reject,
+	}
+	for _, e := range m.Entries {
+		sm.Entries = append(sm.Entries, &pb.Entry{EntryType: e.EntryType, Term: e.Term, Index: e.Index, Data: e.Data})
+	}
+	if m.Snapshot != nil && m.Snapshot.Metadata != nil {
+		sm.Snapshot = &pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: m.Snapshot.Metadata.Index, Term: m.Snapshot.Metadata.Term}}
+	}
+	return sm
+}
+
+// messagesEqual reports whether a and b hold the same messages in any order,
+// ignoring volatile fields. The slices are not modified.
+func messagesEqual(a, b []pb.Message) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sa, sb := make([]pb.Message, len(a)), make([]pb.Message, len(b))
+	for i := range a {
+		sa[i], sb[i] = stripMessage(a[i]), stripMessage(b[i])
+	}
+	return reflect.DeepEqual(sortMessages(sa), sortMessages(sb))
+}
+
+func TestSortMessages2AA(t *testing.T) {
+	msgs := []pb.Message{
+		{MsgType: pb.MessageType_MsgHeartbeat, To: 2},
+		{MsgType: pb.MessageType_MsgAppend, To: 3, Index: 1},
+		{MsgType: pb.MessageType_MsgAppend, To: 2, Index: 5},
+		{MsgType: pb.MessageType_MsgAppend, To: 2, Index: 4},
+		{MsgType: pb.MessageType_MsgHeartbeat, To: 2, From: 1, Term: 2},
+		{MsgType: pb.MessageType_MsgHeartbeat, To: 2, From: 1, Term: 1},
+	}
+	want := []pb.Message{
+		{MsgType: pb.MessageType_MsgAppend, To: 2, Index: 4},
+		{MsgType: pb.MessageType_MsgAppend, To: 2, Index: 5},
+		{MsgType: pb.MessageType_MsgAppend, To: 3, Index: 1},
+		{MsgType: pb.MessageType_MsgHeartbeat, To: 2},
+		{MsgType: pb.MessageType_MsgHeartbeat, To: 2, From: 1, Term: 1},
+		{MsgType: pb.MessageType_MsgHeartbeat, To: 2, From: 1, Term: 2},
+	}
+	if g := sortMessages(msgs); !reflect.DeepEqual(g, want) {
+		t.Errorf("sorted = %+v, want %+v", g, want)
+	}
+}
+
+func TestMessagesEqual2AA(t *testing.T) {
+	tests := []struct {
+		a, b []pb.Message
+		w    bool
+	}{
+		// order doesn't matter
+		{
+			[]pb.Message{{MsgType: pb.MessageType_MsgAppend, To: 2}, {MsgType: pb.MessageType_MsgAppend, To: 3}},
+			[]pb.Message{{MsgType: pb.MessageType_MsgAppend, To: 3}, {MsgType: pb.MessageType_MsgAppend, To: 2}},
+			true,
+		},
+		{
+			[]pb.Message{{MsgType: pb.MessageType_MsgAppendResponse, To: 1, From: 2, Term: 2}, {MsgType: pb.MessageType_MsgAppendResponse, To: 1, From: 3, Term: 1}},
+			[]pb.Message{{MsgType: pb.MessageType_MsgAppendResponse, To: 1, From: 3, Term: 1}, {MsgType: pb.MessageType_MsgAppendResponse, To: 1, From: 2, Term: 2}},
+			true,
+		},
+		// volatile fields and nil vs empty entries are ignored
+		{
+			[]pb.Message{{MsgType: pb.MessageType_MsgAppend, To: 2, XXX_sizecache: 10, Entries: []*pb.Entry{}}},
+			[]pb.Message{{MsgType: pb.MessageType_MsgAppend, To: 2}},
+			true,
+		},
+		{
+			[]pb.Message{{MsgType: pb.MessageType_MsgAppend, To: 2, Entries: []*pb.Entry{{Index: 1, Term: 1, XXX_sizecache: 3}}}},
+			[]pb.Message{{MsgType: pb.MessageType_MsgAppend, To: 2, Entries: []*pb.Entry{{Index: 1, Term: 1}}}},
+			true,
+		},
+		// meaningful fields differ
+		{
+			[]pb.Message{{MsgType: pb.MessageType_MsgAppend, To: 2, Commit: 1}},
+			[]pb.Message{{MsgType: pb.MessageType_MsgAppend, To: 2, Commit: 2}},
+			false,
+		},
+		{
+			[]pb.Message{{MsgType: pb.MessageType_MsgAppend, To: 2}},
+			[]pb.Message{{MsgType: pb.MessageType_MsgAppend, To: 2}, {MsgType: pb.MessageType_MsgAppend, To: 2}},
+			false,
+		},
+	}
+	for i, tt := range tests {
+		a := append([]pb.Message{}, tt.a...)
+		if g := messagesEqual(tt.a, tt.b); g != tt.w {
+			t.Errorf("#%d: equal = %v, want %v", i, g, tt.w)
+		}
+		if !reflect.DeepEqual(a, tt.a) {
+			t.Errorf("#%d: messagesEqual modified its input", i)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package raft
+
+import (
+	"time"
+
+	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
+)
+
+// Observer receives the time raft spends processing, to find what is slow
+// under load, and the leader's lease events. It's called on the raft
+// goroutine and should return quickly.
+// (Set with Config.Observer)
+type Observer interface {
+	// OnStepDuration is called after a message of type t was stepped.
+	OnStepDuration(t pb.MessageType, d time.Duration)
+	// OnTickDuration is called after a tick was processed.
+	OnTickDuration(d time.Duration)
+	// OnReadyDuration is called after a Ready was assembled.
+	OnReadyDuration(d time.Duration)
+	// OnLeaseExpired is called when a leader went an election timeout
+	// without hearing from a quorum, local reads aren't safe from then on.
+	OnLeaseExpired()
+}
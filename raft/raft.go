@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"github.com/pingcap-incubator/tinykv/log"
 	"math/rand"
+	"sort"
 	"time"
 
 	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
@@ -50,6 +51,25 @@ func (st StateType) String() string {
 // so that the proposer can be notified and fail fast.
 var ErrProposalDropped = errors.New("raft proposal dropped")
 
+// ErrDuplicateLeader is returned when a leader receives an append or a
+// heartbeat from another leader of its own term, which raft must never allow.
+var ErrDuplicateLeader = errors.New("raft: another leader in the same term")
+
+// ErrMultipleConfChanges is returned for a proposal carrying more than one
+// conf change. Applied one at a time they go through a configuration no
+// quorum agreed on, changing several nodes at once needs joint consensus,
+// which isn't supported. Propose them one by one instead.
+var ErrMultipleConfChanges = errors.New("raft: more than one conf change in a proposal, needs joint consensus")
+
+// The reasons a proposal would be dropped, reported by RawNode.CanPropose.
+var (
+	ErrNotLeader               = errors.New("raft: not leader")
+	ErrLeaderTransferring      = errors.New("raft: leader transfer in progress")
+	ErrConfChangePending       = errors.New("raft: a conf change is pending")
+	ErrUncommittedSizeExceeded = errors.New("raft: uncommitted entries size limit exceeded")
+	ErrLogSizeExceeded         = errors.New("raft: log size limit exceeded")
+)
+
 // Config contains the parameters to start a raft.
 type Config struct {
 	// ID is the identity of the local raft. ID cannot be 0.
@@ -59,6 +79,10 @@ type Config struct {
 	// should only be set when starting a new raft cluster. Restarting raft from
 	// previous configuration will panic if peers is set. peer is private and only
 	// used for testing right now.
+	//
+	// With no peers and no ConfState in the storage the node starts outside of
+	// any configuration, as a peer replicated by a conf change does: it never
+	// campaigns and waits for a snapshot from the leader to learn the group.
 	peers []uint64
 
 	// ElectionTick is the number of Node.Tick invocations that must pass between
@@ -83,8 +107,131 @@ type Config struct {
 	// Applied. If Applied is unset when restarting, raft might return previous
 	// applied entries. This is a very application dependent configuration.
 	Applied uint64
+
+	// CheckQuorum specifies if the leader should check quorum activity. Leader
+	// steps down when quorum is not active for an electionTimeout. A node that
+	// heard from a leader within an electionTimeout also ignores vote requests
+	// of a higher term, so a partitioned node that comes back with an inflated
+	// term can't unseat a healthy leader.
+	CheckQuorum bool
+
+	// StrictSafety enables assertions on the log: committed entries are never
+	// overwritten and the commit index only moves forward, and that the
+	// election and heartbeat clocks stay within their timeouts. It costs a
+	// few comparisons per entry and tick and is meant for development.
+	StrictSafety bool
+	// AbortHook is called with the reason when a StrictSafety assertion or
+	// the config consistency check fails. If it is nil, raft panics.
+	AbortHook func(reason string)
+
+	// MaxUncommittedEntriesSize limits the aggregate byte size of the entries
+	// data that may sit uncommitted in the leader's log. Once exceeded, proposals
+	// are dropped with ErrProposalDropped. 0 for no limit.
+	MaxUncommittedEntriesSize uint64
+
+	// SkipLeaderNoop stops a new leader appending an empty entry in its term,
+	// for applications that propose their own leadership-change marker. The
+	// leader still only commits entries of its own term, so entries left by
+	// previous leaders, and read index requests, wait until something is
+	// proposed in the new term.
+	SkipLeaderNoop bool
+
+	// ProbeAfterElection makes a new leader send empty appends to each
+	// follower until it learns where the follower's log matches, instead of
+	// optimistically sending entries that a lagging follower rejects.
+	ProbeAfterElection bool
+
+	// QuorumFunc replaces the majority quorum used to win elections and to
+	// commit entries. granted holds true for the voters that granted (for
+	// commit, that have the entry), false for the ones that rejected, and
+	// nothing for the ones that haven't answered. Raft is only safe if any
+	// quorum QuorumFunc accepts intersects every other one, including the
+	// quorums of other nodes running a different QuorumFunc, it's up to the
+	// application to guarantee that. nil for a simple majority.
+	QuorumFunc func(voters []uint64, granted map[uint64]bool) VoteResult
+
+	// BatchProposals holds back the broadcast of proposed entries until the
+	// messages are read, so the proposals stepped in between go out in one
+	// append per follower instead of one each.
+	BatchProposals bool
+
+	// MaxMsgsPerFlush is a soft cap on the messages handed off per read of the
+	// messages. The appends and heartbeats broadcast beyond it are owed and
+	// sent on the next reads, HasReady stays true until they are. Other
+	// messages, e.g. responses, are never held back. 0 for no limit.
+	MaxMsgsPerFlush int
+
+	// VerifyEntries checks the entries loaded from storage on start against
+	// the checksums the storage recorded when appending them, NewRawNode fails
+	// on corruption. The storage must implement ChecksumStorage and record
+	// the checksums, NewRawNode returns ErrNoChecksums otherwise. The
+	// raftstore's PeerStorage doesn't, leave it off there.
+	VerifyEntries bool
+
+	// AsyncApply lets Ready.CommittedEntries hold entries that are not stabled
+	// yet, for an application that persists Ready.Entries and applies
+	// Ready.CommittedEntries concurrently and makes sure an applied entry
+	// survives a crash by itself. By default committed entries are held back
+	// until the Ready that carried them to storage is advanced.
+	AsyncApply bool
+
+	// HeartbeatRetries is how many times, one per tick, a leader with
+	// CheckQuorum resends the heartbeat to a peer it didn't hear from since the
+	// last one, so a lossy link doesn't cost it the lease. The retries stop at
+	// the next heartbeat, at most HeartbeatTick-1 are sent. 0 for none.
+	HeartbeatRetries int
+
+	// CompactionRetainEntries is how many entries below applied are kept in
+	// memory when the log is compacted after the storage, so a follower that
+	// is only a little behind still catches up from the log instead of a
+	// snapshot. 0 keeps none.
+	CompactionRetainEntries uint64
+
+	// BenchMode hands replication to the caller, to measure the raw append
+	// throughput against other raft libraries. Proposals aren't broadcast,
+	// the leader sends no heartbeats and doesn't move the commit index on
+	// append responses, the caller does it with RawNode.BenchBroadcast and
+	// RawNode.BenchCommit. Elections work as usual. Never set it in
+	// production.
+	BenchMode bool
+
+	// MaxLogSize caps the size of the entries data the log keeps in memory,
+	// committed or not. A leader over it drops proposals until compaction
+	// brings it back under, e.g. once a follower holding compaction back has
+	// caught up. Conf changes are still accepted, so that follower can be
+	// removed. 0 for no limit.
+	MaxLogSize uint64
+
+	// DeterministicElection turns off the election timeout jitter, a
+	// follower campaigns after exactly ElectionTick ticks without hearing
+	// from a leader. Tests use it with a different ElectionTick per node to
+	// pick which node campaigns first. Leave it off in production, it's what
+	// keeps split votes rare.
+	DeterministicElection bool
+
+	// LeaderStickiness is how many more ticks than the election timeout a
+	// follower that knows a leader waits before campaigning, so a few lost
+	// heartbeats on a flaky network don't depose a healthy leader. Every
+	// message from the leader starts the wait over. A follower without a
+	// leader, or a candidate, campaigns at the usual timeout. Unlike
+	// CheckQuorum, it's about the followers, not the leader. 0 for none.
+	LeaderStickiness int
+
+	// OnCommitted, if set, is called synchronously each time the committed
+	// index advances, with the new committed index, before the entries are
+	// handed out to apply. Entries committed together make one call with
+	// the last of them, e.g. to release the waiters of all the proposals up
+	// to it early. It must not call back into raft.
+	OnCommitted func(index uint64)
+
+	// Observer, if set, receives the duration of every step, tick and Ready.
+	// Nothing is timed when it's nil.
+	Observer Observer
 }
 
+// minElectionTickRatio is the smallest allowed ElectionTick / HeartbeatTick.
+const minElectionTickRatio = 3
+
 func (c *Config) validate() error {
 	if c.ID == None {
 		return errors.New("cannot use none as id")
@@ -98,10 +245,24 @@ func (c *Config) validate() error {
 		return errors.New("election tick must be greater than heartbeat tick")
 	}
 
+	// with a timeout of only a few heartbeats the randomized range is too
+	// narrow, and split votes keep recurring
+	if c.ElectionTick < minElectionTickRatio*c.HeartbeatTick {
+		return fmt.Errorf("election tick must be at least %d times heartbeat tick", minElectionTickRatio)
+	}
+
 	if c.Storage == nil {
 		return errors.New("storage cannot be nil")
 	}
 
+	if c.HeartbeatRetries < 0 {
+		return errors.New("heartbeat retries cannot be negative")
+	}
+
+	if c.LeaderStickiness < 0 {
+		return errors.New("leader stickiness cannot be negative")
+	}
+
 	return nil
 }
 
@@ -109,6 +270,39 @@ func (c *Config) validate() error {
 // progresses of all followers, and sends entries to the follower based on its progress.
 type Progress struct {
 	Match, Next uint64
+	// ReplicationPaused stops the leader sending appends and heartbeats to
+	// the peer, e.g. while it is under maintenance. The peer is still a member
+	// of the group.
+	ReplicationPaused bool
+	// RecentActive is true if the leader heard from the peer since the last
+	// quorum check. (Used with CheckQuorum)
+	RecentActive bool
+	// Commit is the highest commit index the peer reported in its append
+	// responses. A peer far behind on it is a poor leadership target even
+	// when its Match is high.
+	Commit uint64
+	// Probe is set while the leader doesn't know where the peer's log
+	// matches, appends to it carry no entries until one is accepted.
+	// (Used with ProbeAfterElection)
+	Probe bool
+	// PendingSnapshot is the index of the snapshot last sent to the peer,
+	// until the peer acks or rejects an append, or its commit shows it has
+	// the snapshot. It's given up, so sent again, after an election timeout.
+	// 0 if none is in flight.
+	PendingSnapshot uint64
+	// ReadRound is the latest read round the peer acked a heartbeat of.
+	ReadRound uint64
+	// Inflight is set while a probe sent to the peer is unanswered, until
+	// its next append or heartbeat response. A lost one holds the peer back
+	// only until the next heartbeat.
+	Inflight bool
+}
+
+// IsPaused reports whether the leader must not send appends to the peer
+// now: replication is paused, or it's still waiting on an answer to the
+// probe or the snapshot it sent.
+func (p *Progress) IsPaused() bool {
+	return p.ReplicationPaused || p.Inflight || p.PendingSnapshot != 0
 }
 
 func (p *Progress) mayUpdateIndex(index uint64) {
@@ -116,6 +310,16 @@ func (p *Progress) mayUpdateIndex(index uint64) {
 	p.Next = max(p.Match+1, p.Next)
 }
 
+// maybeDecrTo backs Next off by one after a rejection. Next never goes below
+// Match+1, a reject that would take it there is stale and is ignored.
+func (p *Progress) maybeDecrTo() bool {
+	if p.Next <= p.Match+1 {
+		return false
+	}
+	p.Next--
+	return true
+}
+
 type Raft struct {
 	id      uint64
 	peers   []uint64
@@ -138,6 +342,9 @@ type Raft struct {
 
 	// msgs need to send
 	msgs []pb.Message
+	// the batch returned by the flush before the last one, its backing array
+	// is reused for the next messages
+	spareMsgs []pb.Message
 
 	// the leader id
 	Lead uint64
@@ -169,13 +376,64 @@ type Raft struct {
 	// (Used in 3A conf change)
 	PendingConfIndex          uint64
 	randomizedElectionTimeout int
+
+	checkQuorum  bool
+	strictSafety bool
+	abortHook    func(reason string)
+
+	skipLeaderNoop     bool
+	probeAfterElection bool
+	quorumFunc         func(voters []uint64, granted map[uint64]bool) VoteResult
+	batchProposals     bool
+	maxMsgsPerFlush    int
+	heartbeatRetries   int
+	benchMode          bool
+	maxLogSize         uint64
+	noElectionJitter   bool
+	leaderStickiness   int
+	observer           Observer
+
+	// proposals were appended but not broadcast yet (Used with BatchProposals)
+	proposalsPending bool
+	// the broadcast messages held back by MaxMsgsPerFlush, by peer, and the
+	// index in peers the next flush resumes from
+	owed       map[uint64]pb.MessageType
+	owedCursor int
+	// heartbeat retries left for the peers not heard from since the last
+	// heartbeat (Used with HeartbeatRetries)
+	retriesLeft map[uint64]int
+
+	// size of the uncommitted entries data on the leader, see
+	// Config.MaxUncommittedEntriesSize
+	maxUncommittedSize uint64
+	uncommittedSize    uint64
+
+	// the last HardState handed to the application in Ready
+	prevHardSt pb.HardState
+
+	// the peer that sent the pending snapshot, acked once it's applied
+	snapshotFrom uint64
+
+	// index of the no-op entry appended when this node became leader
+	noopIndex uint64
+	// reads waiting for the no-op to commit or their round to be confirmed
+	pendingReads []readIndexRequest
+	// the round of the latest read, heartbeats carry it in Index
+	readRound uint64
+	// reads ready to be served, returned in Ready
+	readStates []ReadState
 	//tick                      func()
 }
 
-var rd = rand.NewSource(time.Now().UnixNano())
+var rd = rand.New(rand.NewSource(time.Now().UnixNano()))
 
+// randN returns a random number in [0,n), or 0 if n <= 0.
 func randN(n int) int {
-	return int(rd.Int63()) % n
+	if n <= 0 {
+		return 0
+	}
+	// Int63n stays in range where int is 32 bits, truncating Int63 doesn't
+	return int(rd.Int63n(int64(n)))
 }
 
 // newRaft return a raft peer with the given config
@@ -197,6 +455,22 @@ func newRaft(c *Config) *Raft {
 		storage:          c.Storage,
 		heartbeatTimeout: c.HeartbeatTick,
 		electionTimeout:  c.ElectionTick, // [el, 2*el-1]
+		checkQuorum:      c.CheckQuorum,
+		strictSafety:     c.StrictSafety,
+		abortHook:        c.AbortHook,
+
+		maxUncommittedSize: c.MaxUncommittedEntriesSize,
+		skipLeaderNoop:     c.SkipLeaderNoop,
+		probeAfterElection: c.ProbeAfterElection,
+		quorumFunc:         c.QuorumFunc,
+		batchProposals:     c.BatchProposals,
+		maxMsgsPerFlush:    c.MaxMsgsPerFlush,
+		heartbeatRetries:   c.HeartbeatRetries,
+		benchMode:          c.BenchMode,
+		maxLogSize:         c.MaxLogSize,
+		noElectionJitter:   c.DeterministicElection,
+		leaderStickiness:   c.LeaderStickiness,
+		observer:           c.Observer,
 	}
 	if raft.id == 0 {
 		log.Panicf("id is 0, can't not be raft")
@@ -210,33 +484,104 @@ func newRaft(c *Config) *Raft {
 		raft.peers = cfg.Nodes
 	}
 	raft.resetPrs()
+	if c.Applied > 0 {
+		raft.RaftLog.restoreApplied(c.Applied)
+	}
+	raft.RaftLog.applyUnstable = c.AsyncApply
+	raft.RaftLog.retainEntries = c.CompactionRetainEntries
+	raft.RaftLog.onCommitted = c.OnCommitted
 
 	fmt.Printf("New Raft %+v\n", raft)
 	return raft
 }
+
+// resetPrs starts the progress of the peers over, as a new leader does.
+// Nothing a peer holds is known to match our log until it acks it, not even
+// below our snapshot, so their Match starts at 0: a heartbeat must not commit
+// a tail they may have from an older term.
 func (r *Raft) resetPrs() {
 	r.Prs = map[uint64]*Progress{}
 	for _, peer := range r.peers {
-		r.Prs[peer] = &Progress{
-			Match: r.RaftLog.start,
-			Next:  r.RaftLog.LastIndex() + 1,
+		pr := &Progress{Next: r.RaftLog.LastIndex() + 1}
+		if peer == r.id {
+			pr.Match = r.RaftLog.start
 		}
+		r.Prs[peer] = pr
+	}
+}
+
+// resetPrsFromSnapshot rebuilds the progress of the peers after installing a
+// snapshot at index. Nothing is known of their logs yet, a later leader
+// probes from the snapshot on.
+func (r *Raft) resetPrsFromSnapshot(index uint64) {
+	r.Prs = map[uint64]*Progress{}
+	for _, peer := range r.peers {
+		r.Prs[peer] = &Progress{Next: index + 1}
 	}
 }
 
 // sendAppend sends an append RPC with new entries (if any) and the
 // current commit index to the given peer. Returns true if a message was sent.
 func (r *Raft) sendAppend(to uint64) bool {
-	r.send(r.NewAppendMsg(to))
+	pr := r.Prs[to]
+	if pr != nil && pr.IsPaused() {
+		return false
+	}
+	m := r.NewAppendMsg(to)
+	switch {
+	case m.MsgType == pb.MessageType_MsgSnapshot:
+		pr.PendingSnapshot = m.Snapshot.Metadata.Index
+	case m.MsgType == pb.MessageType_MsgAppend && pr.Probe:
+		pr.Inflight = true
+	}
+	r.send(m)
 	return true
 }
 
+// anyFollowerNeedsSnapshot reports whether the leader would have to send a
+// snapshot to some follower, i.e. the entry before its Next is compacted.
+// The entry at start is still known, so Next == First() is served from the
+// log. The application can use it to hold off compaction or to build a
+// snapshot ahead of time. It's false on a non-leader.
+func (r *Raft) anyFollowerNeedsSnapshot() bool {
+	if r.State != StateLeader {
+		return false
+	}
+	for id, pr := range r.Prs {
+		if id != r.id && pr.Next < r.RaftLog.First() {
+			return true
+		}
+	}
+	return false
+}
+
+// isQuiesced reports whether the node has nothing to do until a message
+// arrives: it's a follower of a known leader and has no messages to send,
+// no entries to persist or apply and no snapshot or read pending. A host of
+// many groups may stop ticking it then, and start again on the next
+// message. A leader is never quiesced, it has to tick to send heartbeats,
+// and neither is a node without a leader, which has to tick to campaign.
+func (r *Raft) isQuiesced() bool {
+	if r.State != StateFollower || r.Lead == None {
+		return false
+	}
+	if len(r.msgs) != 0 || len(r.readStates) != 0 {
+		return false
+	}
+	l := r.RaftLog
+	return len(l.unstableEntries()) == 0 && l.truncated.Empty() &&
+		l.committed == l.applied && l.pendingSnapshot == nil
+}
+
 // sendHeartbeat sends a heartbeat RPC to the given peer.
 func (r *Raft) sendHeartbeat(to uint64) {
 	if to == r.id {
 		log.Panicf("send your self ?")
 	}
 	// Your Code Here (2A).
+	if pr := r.Prs[to]; pr != nil && pr.ReplicationPaused {
+		return
+	}
 	msg := r.NewHeartbeatMsg(to) // 匹配
 	r.send(msg)
 	log.Debugf("append msg %s", MessageStr(r, msg))
@@ -253,8 +598,117 @@ func (r *Raft) Visit(f func(idx int, to uint64), sendMe bool) {
 
 }
 
-// tick advances the internal logical clock by a single tick.
-func (r *Raft) tickLeader() {
+// pauseReplication stops sending messages to the peer without removing it
+// from the group, so it still counts toward the quorum size but its Match
+// won't advance until resumeReplication is called.
+func (r *Raft) pauseReplication(to uint64) {
+	pr, ok := r.Prs[to]
+	if !ok || to == r.id {
+		log.Warnf("%s can't pause replication to %d", r.info(), to)
+		return
+	}
+	pr.ReplicationPaused = true
+}
+
+// resumeReplication undoes pauseReplication, a leader sends the peer the
+// entries it missed right away.
+func (r *Raft) resumeReplication(to uint64) {
+	pr, ok := r.Prs[to]
+	if !ok || !pr.ReplicationPaused {
+		return
+	}
+	pr.ReplicationPaused = false
+	if r.State == StateLeader {
+		r.sendAppend(to)
+	}
+}
+
+// quorumActive reports whether a quorum of peers was active since the last
+// check, and clears the activity marks for the next round.
+func (r *Raft) quorumActive() bool {
+	var act int
+	for id, pr := range r.Prs {
+		if id == r.id || pr.RecentActive {
+			act++
+		}
+		pr.RecentActive = false
+	}
+	return act > len(r.Prs)/2
+}
+
+// leaseExpired is called when the leader didn't hear from a quorum within
+// an election timeout.
+func (r *Raft) leaseExpired() {
+	log.Warnf("%s lease expired, quorum is not active", r.info())
+	if r.observer != nil {
+		r.observer.OnLeaseExpired()
+	}
+	if r.checkQuorum {
+		log.Warnf("%s stepped down since quorum is not active", r.info())
+		r.becomeFollower(r.Term, None)
+	}
+}
+
+// visitProgress calls f for every peer in Prs, ordered by descending Match
+// (ties are broken by ascending id, so the order is deterministic).
+// pr points at the live Progress; f may read it but must not modify or
+// retain it after returning.
+func (r *Raft) visitProgress(f func(id uint64, pr *Progress)) {
+	ids := make([]uint64, 0, len(r.Prs))
+	for id := range r.Prs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		mi, mj := r.Prs[ids[i]].Match, r.Prs[ids[j]].Match
+		if mi != mj {
+			return mi > mj
+		}
+		return ids[i] < ids[j]
+	})
+	for _, id := range ids {
+		f(id, r.Prs[id])
+	}
+}
+
+// tickElection advances the election clock. A leader checks quorum activity
+// when it expires (with CheckQuorum), others start an election.
+func (r *Raft) tickElection() {
+	r.electionElapsed++
+	if r.State == StateLeader {
+		if r.electionElapsed >= r.electionTimeout {
+			r.electionElapsed = 0
+			if r.leadTransferee != None {
+				log.Infof("%s abort leader transfer to %d, timed out", r.info(), r.leadTransferee)
+				r.leadTransferee = None
+			}
+			// a snapshot still unanswered is taken as lost, it's sent again
+			// on the next heartbeat response
+			for _, pr := range r.Prs {
+				pr.PendingSnapshot = 0
+			}
+			if r.checkQuorum || r.observer != nil {
+				if !r.quorumActive() {
+					r.leaseExpired()
+				}
+			}
+		}
+		return
+	}
+	if r.pastElectionTimeout() {
+		log.Errorf("%s time out", r.info())
+		r.resetElectionTimeOut()
+		if err := r.Step(pb.Message{From: r.id, MsgType: pb.MessageType_MsgHup}); err != nil {
+			log.Debugf("error occurred during election: %v", err)
+		}
+	}
+	r.checkElapsed()
+}
+
+// tickHeartbeat advances the heartbeat clock, only a leader sends heartbeats.
+func (r *Raft) tickHeartbeat() {
+	if r.State != StateLeader || r.benchMode {
+		return
+	}
 	r.heartbeatElapsed++
 	// Your Code Here (2A).
 	// 发送心跳
@@ -263,35 +717,55 @@ func (r *Raft) tickLeader() {
 		if err := r.Step(pb.Message{MsgType: pb.MessageType_MsgBeat}); err != nil {
 			log.Panic(err)
 		}
+	} else {
+		r.retryHeartbeats()
+	}
+	r.checkElapsed()
+}
+
+// checkElapsed aborts with StrictSafety if a clock went past its timeout
+// without being reset, every timeout resets its clock so they stay bounded
+// however long we run.
+func (r *Raft) checkElapsed() {
+	if !r.strictSafety {
+		return
+	}
+	// randomizedElectionTimeout >= electionTimeout, the leader's bound
+	if bound := r.randomizedElectionTimeout + r.stickiness(); r.electionElapsed > bound || r.electionElapsed < 0 {
+		r.abort(fmt.Sprintf("%s electionElapsed %d out of [0, %d]", r.info(), r.electionElapsed, bound))
+	}
+	if r.heartbeatElapsed > r.heartbeatTimeout || r.heartbeatElapsed < 0 {
+		r.abort(fmt.Sprintf("%s heartbeatElapsed %d out of [0, %d]", r.info(), r.heartbeatElapsed, r.heartbeatTimeout))
 	}
 }
 
+// tick advances both clocks by one tick.
 func (r *Raft) tick() {
-	if r.State == StateLeader {
-		r.tickLeader()
-	} else {
-		r.electionElapsed++
-		if r.pastElectionTimeout() {
-			log.Errorf("%s time out", r.info())
-			r.resetElectionTimeOut()
-			if err := r.Step(pb.Message{From: r.id, MsgType: pb.MessageType_MsgHup}); err != nil {
-				log.Debugf("error occurred during election: %v", err)
-			}
-		}
+	if r.observer != nil {
+		start := time.Now()
+		defer func() { r.observer.OnTickDuration(time.Since(start)) }()
+	}
+	// a node that just won an election starts its heartbeat clock next tick
+	wasLeader := r.State == StateLeader
+	r.tickElection()
+	if wasLeader {
+		r.tickHeartbeat()
 	}
 }
 
-// becomeFollower transform this peer's state to Follower
+// becomeFollower transform this peer's state to Follower. Messages queued
+// before are kept and still sent, they carry the term they were queued at.
 func (r *Raft) becomeFollower(term uint64, lead uint64) {
 	// Your Code Here (2A).
-	r.step = stepFollower
 	// 1. 任期
 	r.reset(term)
 	// 2. 投票
 	// 3. leadId
 	r.Lead = lead
-	r.electionElapsed = 0   // 清空选举超时
-	r.State = StateFollower // 状态改变
+	r.electionElapsed = 0 // 清空选举超时
+	// 状态改变, the step function always changes with the state
+	r.State = StateFollower
+	r.step = stepFollower
 	if r.Term != 0 {
 		log.Infof("%s became %s at term %d Lead:%d", r.info(), r.State, r.Term, lead)
 	}
@@ -300,9 +774,9 @@ func (r *Raft) becomeFollower(term uint64, lead uint64) {
 // becomeCandidate transform this peer's state to candidate
 func (r *Raft) becomeCandidate() {
 	// Your Code Here (2A).
-	r.step = stepCandidate
 	r.reset(r.Term + 1)
 	r.State = StateCandidate
+	r.step = stepCandidate
 	r.Vote = r.id
 	r.votes = map[uint64]bool{} // RESET
 	log.Infof("%s became candidate at term %d", r.info(), r.Term)
@@ -310,8 +784,10 @@ func (r *Raft) becomeCandidate() {
 
 // becomeLeader transform this peer's state to leader
 func (r *Raft) becomeLeader() {
-	if r.Vote == None || r.State != StateCandidate {
-		log.Panicf("vote:%v state:%s", r.Vote, r.State)
+	// only a candidate wins an election, it voted for itself when it
+	// became one, on a single node too
+	if r.State != StateCandidate {
+		log.Panicf("%s can't become leader from %s", r.info(), r.State)
 	}
 	// Your Code Here (2A).
 	// NOTE: Leader should propose a noop entry on its term
@@ -322,47 +798,142 @@ func (r *Raft) becomeLeader() {
 	r.electionElapsed = 0
 	// 3. lead = me
 	r.Lead = r.id
-	entry := &pb.Entry{Term: r.Term, Index: r.RaftLog.LastIndex() + 1, Data: nil}
-	r.leaderAppendEntries(entry)
-	if len(r.peers) == 1 {
-		r.updateCommit()
-	}
+	// reset progress before appending the no-op so followers' Next points at it
 	r.resetPrs()
+	if r.probeAfterElection {
+		for id, pr := range r.Prs {
+			pr.Probe = id != r.id
+		}
+	}
+	if r.skipLeaderNoop {
+		// reads wait for the first entry of this term, whoever proposes it
+		r.noopIndex = r.RaftLog.LastIndex() + 1
+		log.Infof("%s became %s at term %d without no-op", r.info(), r.State, r.Term)
+		return
+	}
+	entry := &pb.Entry{EntryType: pb.EntryType_EntryNormal, Term: r.Term, Index: r.RaftLog.LastIndex() + 1, Data: nil}
+	// we are leader, appending can't fail
+	noopIndex, err := r.leaderAppendEntries(entry)
+	mustBeNil(err)
+	r.noopIndex = noopIndex
 	log.Infof("%s became %s at term %d", r.info(), r.State, r.Term)
 }
 
-// updateCommit update and return commit index
-func (r *Raft) updateCommit() uint64 {
-	prev := r.RaftLog.committed // for debug
-	start := max(prev+1, r.RaftLog.First())
-
-	for index := start; index <= r.RaftLog.LastIndex(); index++ {
-		if r.RaftLog.entries[index-r.RaftLog.start].Term != r.Term {
+// committedIndex returns the largest index replicated on a quorum of the
+// group, i.e. what could be committed if its term is the current one. It
+// doesn't change the commit index.
+func (r *Raft) committedIndex() uint64 {
+	if len(r.peers) == 0 {
+		return 0
+	}
+	matches := make([]uint64, 0, len(r.peers))
+	for _, id := range r.peers {
+		if id == r.id {
+			matches = append(matches, r.RaftLog.LastIndex())
 			continue
 		}
-		var count = 1
+		matches = append(matches, r.Prs[id].Match)
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	if r.quorumFunc == nil {
+		// the (n/2+1)-th largest Match is on a majority
+		return matches[len(matches)/2]
+	}
+	// the largest Match that the peers having it make a quorum of
+	for _, index := range matches {
+		granted := make(map[uint64]bool, len(r.peers))
 		for _, id := range r.peers {
-			if id != r.id && r.Prs[id].Match >= index {
-				count++
-			}
+			granted[id] = id == r.id || r.Prs[id].Match >= index
 		}
-		// 假设存在 N 满足N > CommitIndex，使得大多数的 matchIndex[i] ≥ N以及log[N].term == CurrentTerm 成立，则令 CommitIndex = N（5.3 和 5.4 节）
-		if count > len(r.peers)/2 {
-			r.RaftLog.committed = index
-			log.Debugf("%s update commit to %d", r.info(), r.RaftLog.committed)
+		if r.quorumFunc(append([]uint64{}, r.peers...), granted) == VoteWon {
+			return index
 		}
 	}
+	return 0
+}
+
+// updateCommit update and return commit index
+func (r *Raft) updateCommit() uint64 {
+	// 假设存在 N 满足N > CommitIndex，使得大多数的 matchIndex[i] ≥ N以及log[N].term == CurrentTerm 成立，则令 CommitIndex = N（5.3 和 5.4 节）
+	// entries below the quorum index have terms no higher than its, so only
+	// the quorum index itself needs the term check.
+	index := r.committedIndex()
+	if index <= r.RaftLog.committed || mustTerm(r.RaftLog.Term(index)) != r.Term {
+		return r.RaftLog.committed
+	}
+	r.RaftLog.commitTo(index)
+	log.Debugf("%s update commit to %d", r.info(), r.RaftLog.committed)
 	return r.RaftLog.committed
 }
 
+func (r *Raft) hardState() pb.HardState {
+	return pb.HardState{
+		Term:   r.Term,
+		Vote:   r.Vote,
+		Commit: r.RaftLog.committed,
+	}
+}
+
+// maybeCommit advances the commit index if possible and reports whether it
+// moved, reads held for the no-op are released once it commits.
+func (r *Raft) maybeCommit() bool {
+	oldCommit := r.RaftLog.committed
+	newCommit := r.updateCommit()
+	if r.strictSafety && newCommit < oldCommit {
+		r.abort(fmt.Sprintf("%s commit index moved backward %d -> %d", r.info(), oldCommit, newCommit))
+	}
+	if newCommit <= oldCommit {
+		return false
+	}
+	r.releasePendingReads()
+	return true
+}
+
 func (r *Raft) bckstHeart() {
+	if r.checkQuorum && r.heartbeatRetries > 0 {
+		r.retriesLeft = make(map[uint64]int, len(r.Prs))
+	}
 	r.Visit(func(idx int, to uint64) {
-		r.sendHeartbeat(to)
+		if r.retriesLeft != nil {
+			r.retriesLeft[to] = r.heartbeatRetries
+		}
+		r.heartbeatTo(to)
 	}, false)
 }
+
+// heartbeatTo sends a heartbeat to the peer, or owes it under MaxMsgsPerFlush.
+func (r *Raft) heartbeatTo(to uint64) {
+	if r.maxMsgsPerFlush > 0 {
+		r.owe(to, pb.MessageType_MsgHeartbeat)
+		return
+	}
+	r.sendHeartbeat(to)
+}
+
+// retryHeartbeats resends the heartbeat to the peers that haven't answered
+// since the last one and have retries left.
+func (r *Raft) retryHeartbeats() {
+	for _, to := range r.peers {
+		n := r.retriesLeft[to]
+		if n == 0 {
+			continue
+		}
+		r.retriesLeft[to] = n - 1
+		log.Debugf("%s retry heartbeat to %d, %d retries left", r.info(), to, n-1)
+		r.heartbeatTo(to)
+	}
+}
 func (r *Raft) hup() {
 	if r.State == StateLeader {
-		log.Infof("%s is already leader", r.info())
+		if r.leadTransferee != None {
+			log.Infof("%s is transferring leadership to %d, ignore hup", r.info(), r.leadTransferee)
+		} else {
+			log.Infof("%s is already leader", r.info())
+		}
+		return
+	}
+	if _, ok := r.Prs[r.id]; !ok {
+		log.Infof("%s is not in the group, can't campaign", r.info())
 		return
 	}
 	r.becomeCandidate()
@@ -376,6 +947,76 @@ func (r *Raft) hup() {
 	log.Debugf("send done %+v", r.msgs)
 
 }
+
+// readMessages returns the messages to send and resets the queue. The
+// returned slice is only valid until the next call, its backing array is
+// reused afterward, so the transport must be done with the batch before
+// flushing again. Raft is not safe for concurrent use, callers must not Step
+// while a flush is in progress.
+func (r *Raft) readMessages() []pb.Message {
+	r.flushProposals()
+	r.flushOwed()
+	msgs := r.msgs
+	r.msgs = r.spareMsgs[:0]
+	r.spareMsgs = msgs
+	return msgs
+}
+
+// flushProposals broadcasts the entries held back by BatchProposals. If we're
+// no longer leader there's nothing to send, the entries are left to the new
+// leader like any other uncommitted ones.
+func (r *Raft) flushProposals() {
+	if !r.proposalsPending {
+		return
+	}
+	r.proposalsPending = false
+	if r.State == StateLeader {
+		r.bcastAppend(false)
+	}
+}
+
+// owe holds back a broadcast message of type t (an append or a heartbeat) to
+// peer to, an owed append also covers a heartbeat.
+func (r *Raft) owe(to uint64, t pb.MessageType) {
+	if r.owed == nil {
+		r.owed = map[uint64]pb.MessageType{}
+	}
+	if t == pb.MessageType_MsgAppend || r.owed[to] != pb.MessageType_MsgAppend {
+		r.owed[to] = t
+	}
+}
+
+// flushOwed sends the owed messages, built from the current state, until
+// MaxMsgsPerFlush messages are queued. It resumes from the peer the previous
+// flush stopped at, so every peer gets its turn.
+func (r *Raft) flushOwed() {
+	if len(r.owed) == 0 {
+		return
+	}
+	if r.State != StateLeader || len(r.peers) == 0 {
+		r.owed = nil
+		return
+	}
+	n := len(r.peers)
+	i := 0
+	for ; i < n && len(r.owed) > 0 && len(r.msgs) < r.maxMsgsPerFlush; i++ {
+		to := r.peers[(r.owedCursor+i)%n]
+		t, ok := r.owed[to]
+		if !ok {
+			continue
+		}
+		delete(r.owed, to)
+		if t == pb.MessageType_MsgAppend {
+			r.sendAppend(to)
+		} else {
+			r.sendHeartbeat(to)
+		}
+	}
+	r.owedCursor = (r.owedCursor + i) % n
+}
+
+// send stamps the current term only on messages that have none, a term set
+// by the caller (e.g. a rejection to a stale candidate) is kept.
 func (r *Raft) send(m pb.Message) {
 	if m.Term == None {
 		m.Term = r.Term
@@ -383,6 +1024,11 @@ func (r *Raft) send(m pb.Message) {
 	if m.From == None {
 		m.From = r.id
 	}
+	// only the leader of the current term replicates
+	if (m.MsgType == pb.MessageType_MsgAppend || m.MsgType == pb.MessageType_MsgHeartbeat) &&
+		(r.State != StateLeader || m.Term != r.Term) {
+		log.Panicf("%s send %s at term %d", r.info(), m.MsgType, m.Term)
+	}
 
 	r.msgs = append(r.msgs, m)
 	log.Warnf("send %+v", m)
@@ -398,12 +1044,16 @@ func (r *Raft) handleAppendEntries(m pb.Message) {
 
 	// is prevLog Index
 	prevLog, err := r.RaftLog.entryAt(m.Index)
-	if err != nil { // don't match may be i'm compact or exceed
+	// an append from before our snapshot, e.g. delivered after it, must not
+	// touch the log below it. What we have up to committed matches the
+	// leader, so answer with it and the leader moves on from there.
+	if m.Index < r.RaftLog.start {
+		log.Infof("%s ignore append after %d below snapshot %d", r.info(), m.Index, r.RaftLog.start)
+		index = r.RaftLog.committed
+		goto send
+	}
+	if err != nil { // don't match, exceed
 		reject = true
-		if errors.Is(err, ErrCompacted) {
-			index = r.RaftLog.committed
-			reject = false // the log is consistency is quarom,but is snapshot, leader can send snapshot
-		}
 		goto send
 	}
 	// compare prevLog
@@ -414,25 +1064,50 @@ func (r *Raft) handleAppendEntries(m pb.Message) {
 		goto send
 	}
 
+	// a malformed message must not reach the log
+	if !isContiguous(m.Index, m.Entries) {
+		log.Warningf("%s reject append with non-contiguous entries after %d", r.info(), m.Index)
+		reject = true
+		goto send
+	}
+
 	// append
 	r.resetElectionTimeOut() // todo(in req vote and vote to other)
 	// log
-	r.appendEntries(m.Entries...)
+	index = r.appendEntries(m.Index, m.Entries...)
 	// update commit
 	myCommit = r.RaftLog.committed
 
-	index = m.Index + uint64(len(m.Entries)) // update index all log we received
-	if myCommit < m.Commit {                 // < leader commit
+	// index is the last entry this append covers, not our last index: a
+	// tail past it may be left from an older leader and the leader's commit
+	// says nothing about it
+	if myCommit < m.Commit { // < leader commit
 		r.RaftLog.updateCommitIndex(min(index, m.Commit))
 		log.Infof("%s update commit %d->%d", r.info(), myCommit, min(index, m.Commit))
 	}
 	// update send index
 	log.Debugf("%s commit %d NewIndex: %d LeaderCommit: %d", r.info(), r.RaftLog.committed, index, m.Commit)
 send:
+	if reject {
+		// tell the leader which previous entry we don't have
+		index = m.Index
+	}
 	msg := r.NewRespAppendMsg(m.From, index, reject)
 	r.send(msg)
 	log.Debugf("%s send append response to %x %s", r.info(), m.From, MessageStr(r, msg))
 }
+
+// isContiguous reports whether ents start at prev+1 and their indexes
+// increase by one.
+func isContiguous(prev uint64, ents []*pb.Entry) bool {
+	for i, e := range ents {
+		if e.Index != prev+uint64(i)+1 {
+			return false
+		}
+	}
+	return true
+}
+
 func (r *Raft) resetElectionTimeOut() {
 	r.electionElapsed = 0
 }
@@ -442,88 +1117,438 @@ func (r *Raft) handleHeartbeat(m pb.Message) {
 	// Your Code Here (2A).
 	// 更新选举时间
 	r.resetElectionTimeOut()
+	// an idle follower learns the commit here, the leader capped it to Match
+	r.RaftLog.updateCommitIndex(min(m.Commit, r.RaftLog.LastIndex()))
 	// 发送响应
-	r.send(r.NewRespHeartbeatMsg(m.From))
+	msg := r.NewRespHeartbeatMsg(m.From)
+	// echo the read round, see readIndex
+	msg.Index = m.Index
+	r.send(msg)
 }
 
-// handleSnapshot handle Snapshot RPC request
-func (r *Raft) handleProse(m pb.Message) {
-	r.leaderAppendEntries(m.Entries...)
+// handleProse appends a proposal on the leader. It's accepted before the
+// no-op of this term commits: it lands after the no-op, and only entries of
+// the current term are committed by counting, so it can't commit ahead of it.
+// Reads are what must wait for the no-op, see readIndex.
+func (r *Raft) handleProse(m pb.Message) error {
+	if err := r.dropReason(m.Entries); err != nil {
+		log.Debugf("%s drop proposal: %v", r.info(), err)
+		return dropError(err)
+	}
+	if _, err := r.leaderAppendEntries(m.Entries...); err != nil {
+		log.Debugf("%s drop proposal: %v", r.info(), err)
+		return ErrProposalDropped
+	}
+	// counted once it's in the log, a dropped proposal takes up nothing
+	r.uncommittedSize += proposalSize(m.Entries)
+	if r.benchMode {
+		return nil
+	}
+	if r.batchProposals {
+		r.proposalsPending = true
+		return nil
+	}
 	r.bcastAppend(false)
-	if len(r.peers) == 1 {
-		r.updateCommit()
+	return nil
+}
+
+// dropReason returns why the leader would drop a proposal of ents, or nil if
+// it takes it. RawNode checks it before stepping a proposal, so a dropped
+// one doesn't touch the raft state.
+func (r *Raft) dropReason(ents []*pb.Entry) error {
+	var confChanges int
+	for _, e := range ents {
+		if e.EntryType == pb.EntryType_EntryConfChange {
+			confChanges++
+		}
+	}
+	if confChanges > 1 {
+		return ErrMultipleConfChanges
+	}
+	confChange := confChanges == 1
+	if err := r.checkProposal(confChange); err != nil {
+		return err
+	}
+	s := proposalSize(ents)
+	if !confChange && r.logSizeExceeded(s) {
+		return ErrLogSizeExceeded
+	}
+	if r.uncommittedSizeExceeded(s) {
+		return ErrUncommittedSizeExceeded
+	}
+	return nil
+}
+
+// dropError is the error a dropped proposal returns: ErrProposalDropped, the
+// proposer may retry it later, unless it can never be accepted.
+func dropError(reason error) error {
+	if reason == ErrMultipleConfChanges {
+		return reason
 	}
+	return ErrProposalDropped
 }
+
+// checkProposal returns why a proposal would be dropped, regardless of its
+// size. A conf change also has to wait until the pending one is applied.
+func (r *Raft) checkProposal(confChange bool) error {
+	if r.State != StateLeader {
+		return ErrNotLeader
+	}
+	if r.leadTransferee != None {
+		return ErrLeaderTransferring
+	}
+	if _, ok := r.pendingConfChange(); confChange && ok {
+		return ErrConfChangePending
+	}
+	return nil
+}
+
+// pendingConfChange returns the index of the conf change that is in the log
+// but not applied yet, if there is one. Only one can be pending at a time,
+// so a control plane can use it to hold off a conflicting membership change.
+func (r *Raft) pendingConfChange() (index uint64, present bool) {
+	if r.PendingConfIndex > r.RaftLog.applied {
+		return r.PendingConfIndex, true
+	}
+	return 0, false
+}
+
+// uncommittedSizeExceeded reports whether s more bytes of data would take the
+// uncommitted size over the limit. A proposal is always allowed when nothing
+// is uncommitted, so a single large entry is not stuck.
+func (r *Raft) uncommittedSizeExceeded(s uint64) bool {
+	return r.maxUncommittedSize > 0 && r.uncommittedSize > 0 && r.uncommittedSize+s > r.maxUncommittedSize
+}
+
+// logSizeExceeded reports whether appending s bytes of data would take the
+// log over MaxLogSize. Like the uncommitted size, an empty log takes anything.
+func (r *Raft) logSizeExceeded(s uint64) bool {
+	return r.maxLogSize > 0 && r.RaftLog.dataSize > 0 && r.RaftLog.dataSize+s > r.maxLogSize
+}
+
+// proposalSize is the size of the data of the proposed entries.
+func proposalSize(ents []*pb.Entry) uint64 {
+	var s uint64
+	for _, e := range ents {
+		s += uint64(len(e.Data))
+	}
+	return s
+}
+
+// reduceUncommittedSize releases the size of the committed entries.
+func (r *Raft) reduceUncommittedSize(ents []pb.Entry) {
+	if r.State != StateLeader {
+		return
+	}
+	var s uint64
+	for _, e := range ents {
+		s += uint64(len(e.Data))
+	}
+	if s > r.uncommittedSize {
+		// entries from a previous term are not accounted
+		r.uncommittedSize = 0
+	} else {
+		r.uncommittedSize -= s
+	}
+}
+
+// handleTransferLeader starts a leadership transfer to m.From. Once the
+// transferee's log is up to date it's told to campaign right away with
+// MsgTimeoutNow. The transfer is aborted if it doesn't finish within an
+// election timeout.
+// NOTE: with CheckQuorum the leader grants the transferee's vote request
+// despite its lease, but the other followers still ignore it within theirs,
+// eraftpb has no context to mark a transfer campaign. In a group of three
+// the leader's vote is enough, a larger one waits for their leases to run out.
+func (r *Raft) handleTransferLeader(m pb.Message) {
+	transferee := m.From
+	if _, ok := r.Prs[transferee]; !ok {
+		log.Infof("%s ignore leader transfer to non member %d", r.info(), transferee)
+		return
+	}
+	if transferee == r.id {
+		if r.leadTransferee != None {
+			log.Infof("%s abort leader transfer to %d, transfer back to self", r.info(), r.leadTransferee)
+			r.leadTransferee = None
+		}
+		return
+	}
+	if r.leadTransferee == transferee {
+		log.Infof("%s leader transfer to %d is in progress, ignore", r.info(), transferee)
+		return
+	}
+	log.Infof("%s start leader transfer to %d", r.info(), transferee)
+	r.leadTransferee = transferee
+	r.electionElapsed = 0
+	if r.Prs[transferee].Match == r.RaftLog.LastIndex() {
+		r.send(r.NewTimeoutNowMsg(transferee))
+	} else {
+		r.sendAppend(transferee)
+	}
+}
+
+// handleSnapshot handle Snapshot RPC request
 func (r *Raft) handleSnapshot(m pb.Message) {
 	// Your Code Here (2C).
 	if m.Snapshot == nil || m.Snapshot.Metadata == nil {
 		log.Panicf("recv snapshot is nil")
 	}
 	snapShot := m.Snapshot
-	index, term := snapShot.Metadata.Index, snapShot.Metadata.Term
-	if index < r.RaftLog.First() {
-		log.Debugf("handleSnapshot %s ignore snapshot %d < %d", r.info(), index, r.RaftLog.First())
+	if r.State == StateLeader {
+		// a leader of this term has the most up-to-date log, so no one can
+		// have a snapshot to send it
+		log.Errorf("%s leader ignore snapshot %d from %d at term %d", r.info(), snapShot.Metadata.Index, m.From, m.Term)
+		return
+	}
+	if r.installConfSnapshot(*snapShot) {
+		// the log is untouched and already matches the leader up to the index
+		r.send(r.NewRespAppendMsg(m.From, snapShot.Metadata.Index, false))
+		return
+	}
+	if p := r.RaftLog.pendingSnapshot; p != nil && p.Metadata.Index >= snapShot.Metadata.Index {
+		// a retransmit, the ack goes out once the pending one is applied
+		log.Debugf("%s ignore snapshot %d, %d is pending", r.info(), snapShot.Metadata.Index, p.Metadata.Index)
+		return
+	}
+	if !r.installSnapshot(*snapShot) {
+		// stale snapshot, report our commit so the leader skips past it and
+		// goes back to appending
+		r.send(r.NewRespAppendMsg(m.From, r.RaftLog.committed, false))
 		return
 	}
+	// the log moves to the snapshot and the leader is acked only once the
+	// application confirms it in Advance, see snapshotApplied
 	r.RaftLog.pendingSnapshot = snapShot
+	r.snapshotFrom = m.From
+}
 
-	if snapShot.Metadata.ConfState != nil {
-		newPeers := snapShot.Metadata.ConfState.Nodes
-		prs := make(map[uint64]*Progress)
-		for _, id := range newPeers {
-			if pr, ok := r.Prs[id]; ok {
-				prs[id] = pr
-			} else {
-				prs[id] = &Progress{
-					Match: 0,
-					Next:  r.RaftLog.LastIndex(),
-				}
-			}
-		}
-		r.peers = newPeers
-		r.Prs = prs
+// snapshotApplied is called once the application persisted and applied the
+// pending snapshot at index. The log moves to it, and the leader that sent
+// it learns the follower has it.
+func (r *Raft) snapshotApplied(index uint64) {
+	if !r.RaftLog.stableSnapTo(index) {
+		return
+	}
+	log.Infof("%s cut down log to snapshot %d", r.info(), index)
+	if r.State == StateLeader {
+		return
+	}
+	// entries kept after the snapshot aren't known to match the leader's
+	r.send(r.NewRespAppendMsg(r.snapshotFrom, index, false))
+}
+
+// restore recovers the log and the configuration from the snapshot without
+// going through a leader, so it can also be used to bootstrap a node from an
+// existing dataset. The snapshot is expected to be persisted and applied
+// already. It returns false if the snapshot is not newer than the committed
+// state.
+func (r *Raft) restore(snap pb.Snapshot) bool {
+	if r.installConfSnapshot(snap) {
+		return true
 	}
+	if !r.installSnapshot(snap) {
+		return false
+	}
+	r.RaftLog.cutDown(snap.Metadata.Index, snap.Metadata.Term)
+	r.RaftLog.applied = max(r.RaftLog.applied, snap.Metadata.Index)
+	// a received snapshot it supersedes must not move the log back
+	if p := r.RaftLog.pendingSnapshot; p != nil && p.Metadata.Index <= snap.Metadata.Index {
+		r.RaftLog.pendingSnapshot = nil
+	}
+	return true
+}
+
+// configSnapshot returns a snapshot of the configuration only, at the commit
+// index. It carries no data, so a node that lost its membership but kept its
+// log can recover it without a full data transfer.
+func (r *Raft) configSnapshot() pb.Snapshot {
+	committed := r.RaftLog.committed
+	return pb.Snapshot{
+		Metadata: &pb.SnapshotMetadata{
+			Index:     committed,
+			Term:      mustTerm(r.RaftLog.Term(committed)),
+			ConfState: &pb.ConfState{Nodes: nodes(r)},
+		},
+	}
+}
 
-	r.RaftLog.cutDown(index, term)
-	log.Infof("%s cut down log to %d", r.info(), index)
+// installConfSnapshot rebuilds the configuration from a snapshot without
+// data whose index is already in the log, and leaves the log as it is. It
+// returns false if snap is not such a snapshot, or it is not newer than the
+// committed state.
+func (r *Raft) installConfSnapshot(snap pb.Snapshot) bool {
+	if len(snap.Data) != 0 || snap.Metadata == nil || snap.Metadata.ConfState == nil {
+		return false
+	}
+	index, term := snap.Metadata.Index, snap.Metadata.Term
+	if index <= r.RaftLog.committed || r.RaftLog.IsConflict(index, term) {
+		return false
+	}
+	r.RaftLog.commitTo(index)
+	r.peers = append([]uint64{}, snap.Metadata.ConfState.Nodes...)
+	r.resetPrsFromSnapshot(index)
+	r.assertConfigConsistent()
+	log.Infof("%s restore config %v at %d from snapshot", r.info(), r.peers, index)
+	return true
+}
+
+// installSnapshot moves the configuration to the snapshot, the caller moves
+// the log. It returns false if the snapshot is not newer than the committed
+// state.
+func (r *Raft) installSnapshot(snap pb.Snapshot) bool {
+	if snap.Metadata == nil {
+		log.Panicf("%s restore snapshot without metadata", r.info())
+	}
+	index := snap.Metadata.Index
+	if index <= r.RaftLog.committed {
+		log.Debugf("%s ignore snapshot %d <= committed %d", r.info(), index, r.RaftLog.committed)
+		return false
+	}
+	if cs := snap.Metadata.ConfState; cs != nil {
+		r.peers = append([]uint64{}, cs.Nodes...)
+		r.resetPrsFromSnapshot(index)
+		r.assertConfigConsistent()
+	}
+	return true
 }
 
 // addNode add a new node to raft group
 func (r *Raft) addNode(id uint64) {
 	// Your Code Here (3A).
+	// conf change may be applied again after a snapshot that already has it
+	if _, ok := r.Prs[id]; ok {
+		log.Debugf("%s node %d already in group, ignore add", r.info(), id)
+		return
+	}
+	r.peers = append(r.peers, id)
+	r.Prs[id] = &Progress{Next: r.RaftLog.LastIndex() + 1}
+	log.Infof("%s add node %d, peers %v", r.info(), id, r.peers)
+	r.assertConfigConsistent()
+}
+
+// assertConfigConsistent checks that peers and Prs hold the same nodes. peers
+// keeps the order the messages go out in, Prs the progress, they're updated
+// together and a drift is a bug. It's checked after every conf change, and
+// after every Step with StrictSafety.
+func (r *Raft) assertConfigConsistent() {
+	if reason := r.configMismatch(); reason != "" {
+		r.abort(fmt.Sprintf("%s config mismatch: %s", r.info(), reason))
+	}
+}
+
+// configMismatch returns how peers and Prs disagree, "" if they don't.
+func (r *Raft) configMismatch() string {
+	seen := make(map[uint64]bool, len(r.peers))
+	for _, id := range r.peers {
+		if seen[id] {
+			return fmt.Sprintf("%d twice in peers %v", id, r.peers)
+		}
+		seen[id] = true
+		if _, ok := r.Prs[id]; !ok {
+			return fmt.Sprintf("%d in peers but not in Prs", id)
+		}
+	}
+	for id := range r.Prs {
+		if !seen[id] {
+			return fmt.Sprintf("%d in Prs but not in peers %v", id, r.peers)
+		}
+	}
+	return ""
 }
 
 // removeNode remove a node from raft group
 func (r *Raft) removeNode(id uint64) {
 	// Your Code Here (3A).
+	if _, ok := r.Prs[id]; !ok {
+		log.Debugf("%s node %d not in group, ignore remove", r.info(), id)
+		return
+	}
+	peers := make([]uint64, 0, len(r.peers)-1)
+	for _, p := range r.peers {
+		if p != id {
+			peers = append(peers, p)
+		}
+	}
+	r.peers = peers
+	delete(r.owed, id)
+	delete(r.retriesLeft, id)
+	delete(r.Prs, id)
+	log.Infof("%s remove node %d, peers %v", r.info(), id, r.peers)
+	r.assertConfigConsistent()
+
+	if r.State != StateLeader {
+		return
+	}
+	if id == r.id {
+		// the leader removed itself, let the others elect a new one
+		log.Infof("%s removed itself, step down", r.info())
+		r.becomeFollower(r.Term, None)
+		return
+	}
+	// the quorum is smaller, entries may be committed now
+	if r.maybeCommit() {
+		r.bcastAppend(false)
+	}
 }
 
 func (r *Raft) bcastAppend(me bool) {
 	r.Visit(func(idx int, to uint64) {
+		if r.maxMsgsPerFlush > 0 {
+			r.owe(to, pb.MessageType_MsgAppend)
+			return
+		}
 		r.sendAppend(to)
 	}, me)
 }
 
-// leaderAppendEntries don't boardcast
-func (r *Raft) leaderAppendEntries(es ...*pb.Entry) uint64 {
+// leaderAppendEntries don't boardcast, it returns the new last index. A node
+// that stepped down just before gets ErrNotLeader and nothing is appended.
+func (r *Raft) leaderAppendEntries(es ...*pb.Entry) (uint64, error) {
 	if r.State != StateLeader {
-		log.Panicf("you should check your state %s", r.State)
+		log.Debugf("%s not leader, can't append %d entries", r.info(), len(es))
+		return 0, ErrNotLeader
 	}
 	esA := make([]pb.Entry, len(es))
 	li := r.RaftLog.LastIndex()
 	for i := range es {
 		es[i].Term = r.Term
 		es[i].Index = li + 1 + uint64(i)
+		switch es[i].EntryType {
+		case pb.EntryType_EntryNormal:
+		case pb.EntryType_EntryConfChange:
+			r.PendingConfIndex = es[i].Index
+		default:
+			log.Panicf("%s append entry %d of unknown type %v", r.info(), es[i].Index, es[i].EntryType)
+		}
 		esA[i] = *es[i]
 	}
 	li = r.RaftLog.append(esA...)
-	r.Prs[r.id].Next = li + 1
-	r.Prs[r.id].Match = li
-	return li
+	if pr := r.Prs[r.id]; pr != nil {
+		pr.Next = li + 1
+		pr.Match = li
+	}
+	// a single node is its own quorum, no response will come to commit it
+	if len(r.peers) == 1 && !r.benchMode {
+		r.maybeCommit()
+	}
+	return li, nil
 }
 
-func (r *Raft) appendEntries(entries ...*pb.Entry) uint64 {
+// appendEntries appends the entries following the matching prev, truncating
+// a conflicting tail, and returns the index of the last entry they cover.
+func (r *Raft) appendEntries(prev uint64, entries ...*pb.Entry) uint64 {
+	last := prev + uint64(len(entries))
+	// the entries follow a matching prevLog, so if the last one matches so
+	// do all the others and a retransmit has nothing to append
+	if n := len(entries); n > 0 && !r.RaftLog.IsConflict(entries[n-1].Index, entries[n-1].Term) {
+		return last
+	}
 	for _, entry := range entries {
+		if r.strictSafety && entry.Index <= r.RaftLog.committed && r.RaftLog.Contain(entry.Index) && r.RaftLog.IsConflict(entry.Index, entry.Term) {
+			r.abort(fmt.Sprintf("%s committed entry %d conflicts with term %d", r.info(), entry.Index, entry.Term))
+			// only the entries before it are known to match
+			return entry.Index - 1
+		}
 		// if has this log we should truncate
 		if entry.Index <= r.RaftLog.LastIndex() && r.RaftLog.IsConflict(entry.Index, entry.Term) {
 			log.Debugf("%s truncate log %d", r.info(), entry.Index)
@@ -535,8 +1560,16 @@ func (r *Raft) appendEntries(entries ...*pb.Entry) uint64 {
 		log.Debugf("%s append log %s", r.info(), entry)
 		r.RaftLog.append(*entry)
 	}
-	// update commit
-	return r.RaftLog.LastIndex()
+	return last
+}
+
+// abort reports a StrictSafety violation or a config mismatch.
+func (r *Raft) abort(reason string) {
+	if r.abortHook != nil {
+		r.abortHook(reason)
+		return
+	}
+	log.Panic(reason)
 }
 
 func (r *Raft) reset(term uint64) {
@@ -549,11 +1582,29 @@ func (r *Raft) reset(term uint64) {
 	r.electionElapsed = 0
 	r.heartbeatElapsed = 0
 	r.votes = map[uint64]bool{}
+	r.pendingReads = nil
+	r.owed = nil
+	r.retriesLeft = nil
+	r.uncommittedSize = 0
+	r.leadTransferee = None
 }
 func (r *Raft) resetRandomizedElectionTimeout() {
+	if r.noElectionJitter {
+		r.randomizedElectionTimeout = r.electionTimeout
+		return
+	}
 	r.randomizedElectionTimeout = r.electionTimeout + randN(r.electionTimeout)
 }
 
 func (r *Raft) pastElectionTimeout() bool {
-	return r.electionElapsed >= r.randomizedElectionTimeout
+	return r.electionElapsed >= r.randomizedElectionTimeout+r.stickiness()
+}
+
+// stickiness is the extra wait of a follower that knows a leader.
+// (Used with Config.LeaderStickiness)
+func (r *Raft) stickiness() int {
+	if r.State == StateFollower && r.Lead != None {
+		return r.leaderStickiness
+	}
+	return 0
 }
@@ -421,7 +421,7 @@ func TestLeaderCommitEntry2AB(t *testing.T) {
 		t.Errorf("committed = %d, want %d", g, li+1)
 	}
 	wents := []pb.Entry{{Index: li + 1, Term: 1, Data: []byte("some data")}}
-	if g := r.RaftLog.nextEnts(); !reflect.DeepEqual(g, wents) {
+	if g := nextEnts(r, s); !reflect.DeepEqual(g, wents) {
 		t.Errorf("nextEnts = %+v, want %+v", g, wents)
 	}
 	msgs := r.readMessages()
@@ -508,7 +508,7 @@ func TestLeaderCommitPrecedingEntries2AB(t *testing.T) {
 
 		li := uint64(len(tt))
 		wents := append(tt, pb.Entry{Term: 3, Index: li + 1}, pb.Entry{Term: 3, Index: li + 2, Data: []byte("some data")})
-		if g := r.RaftLog.nextEnts(); !reflect.DeepEqual(g, wents) {
+		if g := nextEnts(r, storage); !reflect.DeepEqual(g, wents) {
 			t.Errorf("#%d: \nents = %+v\n want %+v", i, g, wents)
 		}
 	}
@@ -551,7 +551,8 @@ func TestFollowerCommitEntry2AB(t *testing.T) {
 		},
 	}
 	for i, tt := range tests {
-		r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+		storage := NewMemoryStorage()
+		r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, storage)
 		r.becomeFollower(1, 2)
 
 		r.Step(pb.Message{From: 2, To: 1, MsgType: pb.MessageType_MsgAppend, Term: 1, Entries: tt.ents, Commit: tt.commit})
@@ -563,7 +564,7 @@ func TestFollowerCommitEntry2AB(t *testing.T) {
 		for _, ent := range tt.ents[:int(tt.commit)] {
 			wents = append(wents, *ent)
 		}
-		if g := r.RaftLog.nextEnts(); !reflect.DeepEqual(g, wents) {
+		if g := nextEnts(r, storage); !reflect.DeepEqual(g, wents) {
 			t.Errorf("#%d: nextEnts = %v, want %v", i, g, wents)
 		}
 	}
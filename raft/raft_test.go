@@ -20,6 +20,7 @@ import (
 	"github.com/pingcap-incubator/tinykv/log"
 	"math/rand"
 	"reflect"
+	"strings"
 	"testing"
 
 	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
@@ -49,13 +50,6 @@ type stateMachine interface {
 	readMessages() []pb.Message
 }
 
-func (r *Raft) readMessages() []pb.Message {
-	msgs := r.msgs
-	r.msgs = make([]pb.Message, 0)
-
-	return msgs
-}
-
 func TestProgressLeader2AB(t *testing.T) {
 	log.SetLevel(log.LOG_LEVEL_ALL)
 	r := newTestRaft(1, []uint64{1, 2}, 5, 1, NewMemoryStorage())
@@ -123,6 +117,110 @@ func TestLeaderCycle2AA(t *testing.T) {
 	}
 }
 
+// TestDeterministicElection2AA tests that with DeterministicElection the node
+// with the smallest ElectionTick campaigns first, on exactly that tick.
+func TestDeterministicElection2AA(t *testing.T) {
+	ids := []uint64{1, 2, 3}
+	ticks := map[uint64]int{1: 14, 2: 10, 3: 12}
+	rs := make(map[uint64]*Raft)
+	for _, id := range ids {
+		cfg := newTestConfig(id, ids, ticks[id], 1, NewMemoryStorage())
+		cfg.DeterministicElection = true
+		rs[id] = newRaft(cfg)
+	}
+	for i := 1; i <= 10; i++ {
+		for _, id := range ids {
+			rs[id].tick()
+		}
+		if i < 10 {
+			for _, id := range ids {
+				if rs[id].State != StateFollower {
+					t.Fatalf("tick %d: %d state = %v, want %v", i, id, rs[id].State, StateFollower)
+				}
+			}
+		}
+	}
+	if rs[2].State != StateCandidate {
+		t.Errorf("2 state = %v, want %v", rs[2].State, StateCandidate)
+	}
+	for _, id := range []uint64{1, 3} {
+		if rs[id].State != StateFollower {
+			t.Errorf("%d state = %v, want %v", id, rs[id].State, StateFollower)
+		}
+	}
+}
+
+// TestLeaderStickiness2AA tests that a follower hearing from a leader waits
+// LeaderStickiness ticks past its election timeout before campaigning, and
+// that each leader message starts the wait over.
+func TestLeaderStickiness2AA(t *testing.T) {
+	cfg := newTestConfig(2, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	cfg.DeterministicElection = true
+	cfg.LeaderStickiness = 5
+	r := newRaft(cfg)
+	r.becomeFollower(1, 1)
+	heartbeat := pb.Message{MsgType: pb.MessageType_MsgHeartbeat, From: 1, To: 2, Term: 1}
+
+	// a heartbeat is lost, the follower stays put past its timeout
+	for i := 0; i < 12; i++ {
+		r.tick()
+	}
+	if r.State != StateFollower {
+		t.Fatalf("state = %v, want %v", r.State, StateFollower)
+	}
+	r.Step(heartbeat)
+	for i := 0; i < 14; i++ {
+		r.tick()
+	}
+	if r.State != StateFollower {
+		t.Fatalf("state = %v, want %v", r.State, StateFollower)
+	}
+	r.tick()
+	if r.State != StateCandidate {
+		t.Fatalf("state = %v, want %v", r.State, StateCandidate)
+	}
+
+	// without a leader the usual timeout applies
+	r = newRaft(cfg)
+	for i := 0; i < 10; i++ {
+		r.tick()
+	}
+	if r.State != StateCandidate {
+		t.Errorf("leaderless state = %v, want %v", r.State, StateCandidate)
+	}
+}
+
+// TestIsQuiesced2AB tests that an idle follower of a known leader reports
+// quiesced, while the leader and a follower with work left do not.
+func TestIsQuiesced2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("x")}}})
+	lead, n2 := nt.peers[1].(*Raft), nt.peers[2].(*Raft)
+
+	if lead.isQuiesced() {
+		t.Errorf("leader is quiesced, want not")
+	}
+	// the entries are committed but not applied yet
+	if n2.isQuiesced() {
+		t.Errorf("follower with unapplied entries is quiesced, want not")
+	}
+	n2.RaftLog.stabled = n2.RaftLog.LastIndex()
+	n2.RaftLog.applied = n2.RaftLog.committed
+	if !n2.isQuiesced() {
+		t.Errorf("idle follower is not quiesced, want quiesced")
+	}
+
+	n2.Step(pb.Message{From: 1, To: 2, Term: lead.Term, MsgType: pb.MessageType_MsgHeartbeat})
+	if n2.isQuiesced() {
+		t.Errorf("follower with a message to send is quiesced, want not")
+	}
+	n2.readMessages()
+	if !n2.isQuiesced() {
+		t.Errorf("follower is not quiesced after its messages are sent")
+	}
+}
+
 // TestLeaderElectionOverwriteNewerLogs tests a scenario in which a
 // newly-elected leader does *not* have the newest (i.e. highest term)
 // log entries, and must overwrite higher-term log entries with
@@ -496,6 +594,37 @@ func TestSingleNodeCandidate2AA(t *testing.T) {
 	}
 }
 
+// TestBecomeLeaderPrecondition2AA tests that a single node and a cluster
+// both get through becomeLeader, and that becoming leader from a state other
+// than candidate panics.
+func TestBecomeLeaderPrecondition2AA(t *testing.T) {
+	for _, size := range []int{1, 3} {
+		nt := newNetwork(make([]stateMachine, size)...)
+		nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+		if sm := nt.peers[1].(*Raft); sm.State != StateLeader {
+			t.Errorf("size %d: state = %v, want %v", size, sm.State, StateLeader)
+		}
+	}
+
+	tests := []func(r *Raft){
+		func(r *Raft) {},
+		func(r *Raft) { r.becomeFollower(1, None) },
+		func(r *Raft) { r.becomeCandidate(); r.becomeLeader() },
+	}
+	for i, setup := range tests {
+		r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+		setup(r)
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("#%d: becomeLeader from %v didn't panic", i, r.State)
+				}
+			}()
+			r.becomeLeader()
+		}()
+	}
+}
+
 func TestOldMessages2AB(t *testing.T) {
 	tt := newNetwork(nil, nil, nil)
 	// make 0 leader @ term 3
@@ -567,6 +696,41 @@ func TestProposal2AB(t *testing.T) {
 	}
 }
 
+// TestProposalBeforeNoopCommit2AB tests that a proposal made a tick after the
+// election, while the no-op isn't committed yet, is appended after it and
+// commits with it instead of being dropped.
+func TestProposalBeforeNoopCommit2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.isolate(2)
+	nt.isolate(3)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	// the votes were lost, grant them by hand so nothing is acked
+	sm := nt.peers[1].(*Raft)
+	sm.Step(pb.Message{From: 2, To: 1, Term: sm.Term, MsgType: pb.MessageType_MsgRequestVoteResponse})
+	if sm.State != StateLeader {
+		t.Fatalf("state = %v, want %v", sm.State, StateLeader)
+	}
+	noop := sm.RaftLog.LastIndex()
+	sm.tick()
+	if sm.RaftLog.committed >= noop {
+		t.Fatalf("committed = %d, want the no-op %d not committed", sm.RaftLog.committed, noop)
+	}
+
+	if err := sm.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}}); err != nil {
+		t.Fatalf("propose = %v, want nil", err)
+	}
+	if e, err := sm.RaftLog.entryAt(noop + 1); err != nil || string(e.Data) != "somedata" {
+		t.Fatalf("entryAt(%d) = %+v, %v, want the proposal", noop+1, e, err)
+	}
+
+	nt.recover()
+	sm.readMessages()
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+	if g := sm.RaftLog.committed; g != noop+1 {
+		t.Errorf("committed = %d, want %d", g, noop+1)
+	}
+}
+
 // TestHandleMessageType_MsgAppend ensures:
 //  1. Reply false if log doesn’t contain an entry at prevLogIndex whose term matches prevLogTerm.
 //  2. If an existing entry conflicts with a new one (same index but different terms),
@@ -622,6 +786,332 @@ func TestHandleMessageType_MsgAppend2AB(t *testing.T) {
 	}
 }
 
+// TestFollowerStaleTailNotCommitted2AB tests that a follower holding a tail
+// from an older leader past what an append covers commits only up to the
+// append, however far the leader's commit is.
+func TestFollowerStaleTailNotCommitted2AB(t *testing.T) {
+	tests := []struct {
+		m       pb.Message
+		wCommit uint64
+	}{
+		// heartbeat-like append matching entry 1
+		{pb.Message{MsgType: pb.MessageType_MsgAppend, Term: 3, LogTerm: 1, Index: 1, Commit: 4}, 1},
+		// retransmit of an entry we already have
+		{pb.Message{MsgType: pb.MessageType_MsgAppend, Term: 3, LogTerm: 1, Index: 1, Commit: 4, Entries: []*pb.Entry{{Index: 2, Term: 2}}}, 2},
+		// leader commit below the append
+		{pb.Message{MsgType: pb.MessageType_MsgAppend, Term: 3, LogTerm: 2, Index: 2, Commit: 2}, 2},
+	}
+	for i, tt := range tests {
+		storage := NewMemoryStorage()
+		storage.Append([]pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 2}, {Index: 3, Term: 2}, {Index: 4, Term: 2}})
+		r := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+		r.becomeFollower(3, 2)
+		tt.m.From, tt.m.To = 2, 1
+		r.Step(tt.m)
+		if r.RaftLog.committed != tt.wCommit {
+			t.Errorf("#%d: committed = %d, want %d", i, r.RaftLog.committed, tt.wCommit)
+		}
+		if r.RaftLog.LastIndex() != 4 {
+			t.Errorf("#%d: lastIndex = %d, want 4", i, r.RaftLog.LastIndex())
+		}
+	}
+}
+
+// TestOnCommitted2AB tests that OnCommitted is called once each time the
+// commit index advances, with the new index, on the leader and the follower.
+func TestOnCommitted2AB(t *testing.T) {
+	var calls []uint64
+	cfg := newTestConfig(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	cfg.OnCommitted = func(index uint64) { calls = append(calls, index) }
+	sm := newRaft(cfg)
+	sm.becomeCandidate()
+	sm.becomeLeader()
+	ack := func(index uint64) {
+		sm.Step(pb.Message{From: 2, To: 1, Term: sm.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: index})
+	}
+	ack(1)
+	sm.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("a")}}})
+	ack(2)
+	sm.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("b")}, {Data: []byte("c")}, {Data: []byte("d")}}})
+	ack(5)
+	// a stale ack moves nothing
+	ack(4)
+	if w := []uint64{1, 2, 5}; !reflect.DeepEqual(calls, w) {
+		t.Errorf("leader calls = %v, want %v", calls, w)
+	}
+
+	calls = nil
+	cfg = newTestConfig(2, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	cfg.OnCommitted = func(index uint64) { calls = append(calls, index) }
+	f := newRaft(cfg)
+	ents := []*pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}}
+	f.Step(pb.Message{From: 1, To: 2, Term: 1, MsgType: pb.MessageType_MsgAppend, Commit: 3, Entries: ents})
+	f.Step(pb.Message{From: 1, To: 2, Term: 1, MsgType: pb.MessageType_MsgAppend, LogTerm: 1, Index: 3, Commit: 3})
+	if w := []uint64{3}; !reflect.DeepEqual(calls, w) {
+		t.Errorf("follower calls = %v, want %v", calls, w)
+	}
+}
+
+// TestMaxLogSize2AB tests that a leader whose log can't be compacted behind a
+// stuck follower drops proposals once it's over MaxLogSize, still takes the
+// conf change removing the follower, and takes proposals again once the log
+// is compacted.
+func TestMaxLogSize2AB(t *testing.T) {
+	s := NewMemoryStorage()
+	c := newTestConfig(1, []uint64{1, 2, 3}, 10, 1, s)
+	c.MaxLogSize = 100
+	r := newRaft(c)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+
+	// 3 is stuck, 2 acks everything
+	propose := func(ents ...*pb.Entry) error {
+		err := r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: ents})
+		r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: r.RaftLog.LastIndex()})
+		r.readMessages()
+		return err
+	}
+	data := make([]byte, 10)
+	var accepted int
+	for i := 0; i < 20; i++ {
+		if err := propose(&pb.Entry{Data: data}); err != nil {
+			if err != ErrProposalDropped {
+				t.Fatalf("propose = %v, want %v", err, ErrProposalDropped)
+			}
+			break
+		}
+		accepted++
+	}
+	if accepted != 10 {
+		t.Errorf("accepted %d proposals, want 10", accepted)
+	}
+	if g := r.RaftLog.dataSize; g != 100 {
+		t.Errorf("dataSize = %d, want 100", g)
+	}
+	rn := &RawNode{Raft: r}
+	if ok, err := rn.CanPropose(); ok || err != ErrLogSizeExceeded {
+		t.Errorf("canPropose = %v, %v, want false, %v", ok, err, ErrLogSizeExceeded)
+	}
+
+	cc, _ := (&pb.ConfChange{ChangeType: pb.ConfChangeType_RemoveNode, NodeId: 3}).Marshal()
+	if err := propose(&pb.Entry{EntryType: pb.EntryType_EntryConfChange, Data: cc}); err != nil {
+		t.Errorf("propose conf change = %v, want nil", err)
+	}
+
+	// the application compacts what's applied
+	s.Append(r.RaftLog.unstableEntries())
+	r.RaftLog.stabled = r.RaftLog.LastIndex()
+	r.RaftLog.applied = r.RaftLog.committed
+	if err := s.Compact(r.RaftLog.applied); err != nil {
+		t.Fatal(err)
+	}
+	r.RaftLog.maybeCompact()
+	if g := r.RaftLog.dataSize; g != entsDataSize(r.RaftLog.allEntries()) || g >= 100 {
+		t.Errorf("dataSize after compaction = %d, want the %d left", g, entsDataSize(r.RaftLog.allEntries()))
+	}
+	if err := propose(&pb.Entry{Data: data}); err != nil {
+		t.Errorf("propose after compaction = %v, want nil", err)
+	}
+}
+
+// TestBenchModeSameLog2AB tests that with BenchMode, a harness driving the
+// broadcast and the commit by hand ends with the same committed log as the
+// normal replication, and that nothing moves until it does.
+func TestBenchModeSameLog2AB(t *testing.T) {
+	run := func(bench bool) *network {
+		nt := newNetworkWithConfig(func(c *Config) { c.BenchMode = bench }, nil, nil, nil)
+		nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+		for i := 0; i < 5; i++ {
+			nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte{byte(i)}}}})
+		}
+		if !bench {
+			return nt
+		}
+		lead := nt.peers[1].(*Raft)
+		if lead.RaftLog.committed != 0 || lead.RaftLog.LastIndex() != 6 {
+			t.Fatalf("bench: committed, last = %d, %d before the harness, want 0, 6", lead.RaftLog.committed, lead.RaftLog.LastIndex())
+		}
+		for i := 0; i < 2*lead.heartbeatTimeout; i++ {
+			lead.tick()
+		}
+		if msgs := lead.readMessages(); len(msgs) != 0 {
+			t.Fatalf("bench: msgs = %+v, want none before the harness", msgs)
+		}
+		rn := &RawNode{Raft: lead}
+		rn.BenchBroadcast()
+		nt.send(lead.readMessages()...)
+		if !rn.BenchCommit() {
+			t.Fatalf("bench: commit didn't move")
+		}
+		rn.BenchBroadcast()
+		nt.send(lead.readMessages()...)
+		return nt
+	}
+
+	normal, bench := run(false), run(true)
+	for id := uint64(1); id <= 3; id++ {
+		nl, bl := normal.peers[id].(*Raft).RaftLog, bench.peers[id].(*Raft).RaftLog
+		if nl.committed != 6 || bl.committed != nl.committed {
+			t.Errorf("#%d: committed = %d, bench %d, want 6", id, nl.committed, bl.committed)
+		}
+		if !reflect.DeepEqual(bl.allEntries(), nl.allEntries()) {
+			t.Errorf("#%d: bench entries = %+v, want %+v", id, bl.allEntries(), nl.allEntries())
+		}
+	}
+}
+
+// TestFollowerRewindResync2AB tests that a follower coming back with less of
+// the log than it acked makes the leader reset its progress to the follower's
+// commit and replicate the rest again.
+func TestFollowerRewindResync2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	for i := 0; i < 3; i++ {
+		nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("x")}}})
+	}
+	lead := nt.peers[1].(*Raft)
+	li := lead.RaftLog.LastIndex()
+	if g := lead.Prs[2].Match; g != li {
+		t.Fatalf("match of 2 = %d, want %d", g, li)
+	}
+
+	// 2 restarts with only the first two entries and a commit of 2
+	s := NewMemoryStorage()
+	s.Append(lead.RaftLog.allEntries()[:2])
+	s.SetHardState(pb.HardState{Term: lead.Term, Commit: 2})
+	n2 := newTestRaft(2, []uint64{1, 2, 3}, 10, 1, s)
+	nt.peers[2] = n2
+
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("y")}}})
+	if g, w := n2.RaftLog.allEntries(), lead.RaftLog.allEntries(); !reflect.DeepEqual(g, w) {
+		t.Errorf("2 entries = %+v, want %+v", g, w)
+	}
+	if g := lead.Prs[2].Match; g != lead.RaftLog.LastIndex() {
+		t.Errorf("match of 2 = %d, want %d", g, lead.RaftLog.LastIndex())
+	}
+}
+
+// TestDelayedRejectAtMatch2AB tests that a reject of the entry at a
+// follower's Match delivered after the follower acked it doesn't reset its
+// progress: the leader probes the Match, and the follower still has it.
+func TestDelayedRejectAtMatch2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("x")}}})
+	lead := nt.peers[1].(*Raft)
+	li := lead.RaftLog.LastIndex()
+
+	lead.Step(pb.Message{From: 2, To: 1, Term: lead.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: li, Commit: 1, Reject: true})
+	if pr := lead.Prs[2]; pr.Match != li || !pr.Probe {
+		t.Fatalf("match, probe of 2 = %d, %v, want %d, true", pr.Match, pr.Probe, li)
+	}
+	msgs := lead.readMessages()
+	if len(msgs) != 1 || msgs[0].To != 2 || msgs[0].MsgType != pb.MessageType_MsgAppend || msgs[0].Index != li {
+		t.Fatalf("msgs = %+v, want a probe of %d to 2", msgs, li)
+	}
+	nt.send(msgs...)
+	if pr := lead.Prs[2]; pr.Match != li || pr.Probe {
+		t.Errorf("match, probe of 2 = %d, %v, want %d, false", pr.Match, pr.Probe, li)
+	}
+}
+
+// TestFollowerLongerDivergentTail2AB tests that a follower holding more
+// entries than the leader, from a deposed leader's term, backs off to the
+// match and ends up with the leader's log.
+func TestFollowerLongerDivergentTail2AB(t *testing.T) {
+	storage := func(extra ...pb.Entry) *MemoryStorage {
+		s := NewMemoryStorage()
+		s.Append(append([]pb.Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2}}, extra...))
+		s.SetHardState(pb.HardState{Term: 2})
+		return s
+	}
+	n1 := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, storage())
+	n2 := newTestRaft(2, []uint64{1, 2, 3}, 10, 1, storage(pb.Entry{Term: 2, Index: 3}, pb.Entry{Term: 2, Index: 4}, pb.Entry{Term: 2, Index: 5}))
+	n3 := newTestRaft(3, []uint64{1, 2, 3}, 10, 1, storage())
+	nt := newNetwork(n1, n2, n3)
+
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	if n1.State != StateLeader {
+		t.Fatalf("state = %v, want %v", n1.State, StateLeader)
+	}
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("x")}}})
+
+	want := n1.RaftLog.allEntries()
+	if len(want) != 4 {
+		t.Fatalf("leader entries = %+v, want 4", want)
+	}
+	if g := n2.RaftLog.allEntries(); !reflect.DeepEqual(g, want) {
+		t.Errorf("follower entries = %+v, want %+v", g, want)
+	}
+	if g := n2.RaftLog.committed; g != 4 {
+		t.Errorf("follower committed = %d, want 4", g)
+	}
+}
+
+// TestHandleMsgAppendRetransmit2AB ensures an append whose entries are all in
+// the log already leaves the log as it is and only moves the commit index.
+func TestHandleMsgAppendRetransmit2AB(t *testing.T) {
+	storage := NewMemoryStorage()
+	ents := []pb.Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2}, {Term: 1, Index: 3}, {Term: 2, Index: 4}, {Term: 2, Index: 5}}
+	storage.Append(ents)
+	sm := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+	sm.becomeFollower(2, 2)
+	sm.RaftLog.committed = 1
+
+	sm.Step(pb.Message{From: 2, To: 1, Term: 2, MsgType: pb.MessageType_MsgAppend, LogTerm: 1, Index: 2, Commit: 4,
+		Entries: []*pb.Entry{{Term: 1, Index: 3}, {Term: 2, Index: 4}}})
+
+	if !reflect.DeepEqual(sm.RaftLog.allEntries(), ents) {
+		t.Errorf("entries = %+v, want %+v", sm.RaftLog.allEntries(), ents)
+	}
+	if sm.RaftLog.stabled != 5 {
+		t.Errorf("stabled = %d, want 5", sm.RaftLog.stabled)
+	}
+	if sm.RaftLog.committed != 4 {
+		t.Errorf("committed = %d, want 4", sm.RaftLog.committed)
+	}
+	msgs := sm.readMessages()
+	if len(msgs) != 1 || msgs[0].Reject || msgs[0].Index != 4 {
+		t.Errorf("msgs = %+v, want an accepted append response at index 4", msgs)
+	}
+}
+
+// TestHandleMsgAppendGap2AB ensures an append whose entries don't follow the
+// previous index contiguously is rejected and leaves the log untouched.
+func TestHandleMsgAppendGap2AB(t *testing.T) {
+	tests := []pb.Message{
+		// first entry doesn't follow Index
+		{MsgType: pb.MessageType_MsgAppend, Term: 2, LogTerm: 1, Index: 1, Commit: 3, Entries: []*pb.Entry{{Index: 3, Term: 2}}},
+		// gap inside the entries
+		{MsgType: pb.MessageType_MsgAppend, Term: 2, LogTerm: 2, Index: 2, Commit: 3, Entries: []*pb.Entry{{Index: 3, Term: 2}, {Index: 5, Term: 2}}},
+		// entries going backward
+		{MsgType: pb.MessageType_MsgAppend, Term: 2, LogTerm: 1, Index: 1, Commit: 3, Entries: []*pb.Entry{{Index: 2, Term: 3}, {Index: 2, Term: 3}}},
+	}
+
+	for i, m := range tests {
+		storage := NewMemoryStorage()
+		storage.Append([]pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 2}})
+		sm := newTestRaft(1, []uint64{1}, 10, 1, storage)
+		sm.becomeFollower(2, None)
+
+		sm.handleAppendEntries(m)
+		msgs := sm.readMessages()
+		if len(msgs) != 1 || !msgs[0].Reject {
+			t.Fatalf("#%d: msgs = %+v, want one reject", i, msgs)
+		}
+		if l := sm.RaftLog.LastIndex(); l != 2 {
+			t.Errorf("#%d: lastIndex = %d, want 2", i, l)
+		}
+		if term := mustTerm(sm.RaftLog.Term(2)); term != 2 {
+			t.Errorf("#%d: term at 2 = %d, want 2", i, term)
+		}
+		if sm.RaftLog.committed != 0 {
+			t.Errorf("#%d: committed = %d, want 0", i, sm.RaftLog.committed)
+		}
+	}
+}
+
 func TestRecvMessageType_MsgRequestVote2AB(t *testing.T) {
 	msgType := pb.MessageType_MsgRequestVote
 	msgRespType := pb.MessageType_MsgRequestVoteResponse
@@ -909,70 +1399,368 @@ func TestDisruptiveFollower2AA(t *testing.T) {
 	}
 }
 
-func TestHeartbeatUpdateCommit2AB(t *testing.T) {
-	log.SetLevel(log.LOG_LEVEL_ALL)
-	tests := []struct {
-		failCnt    int
-		successCnt int
-	}{
-		{1, 1},
-		{5, 3},
-		{5, 10},
+// campaignVotes returns a copy of the votes r recorded and the term it
+// campaigns at, for tests to check the counting.
+func campaignVotes(r *Raft) (map[uint64]bool, uint64) {
+	votes := make(map[uint64]bool, len(r.votes))
+	for id, v := range r.votes {
+		votes[id] = v
 	}
-	for i, tt := range tests {
-		t.Log(i)
-		sm1 := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
-		sm2 := newTestRaft(2, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
-		sm3 := newTestRaft(3, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
-		nt := newNetwork(sm1, sm2, sm3)
-		nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
-		t.Log("send done")
-		nt.isolate(1)
-		t.Log("isolate 1")
-		// propose log to old leader should fail
-		for i := 0; i < tt.failCnt; i++ {
-			nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{}}})
-		}
-		if sm1.RaftLog.committed > 1 {
-			t.Fatalf("#%d: unexpected commit: %d", i, sm1.RaftLog.committed)
-		}
-		t.Logf("\n\n\n")
-		// propose log to cluster should success
-		nt.send(pb.Message{From: 2, To: 2, MsgType: pb.MessageType_MsgHup})
-		for i := 0; i < tt.successCnt; i++ {
-			nt.send(pb.Message{From: 2, To: 2, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{}}})
+	return votes, r.Term
+}
+
+// TestPollCountsOnce2AA tests that a candidate counts one vote per peer, a
+// repeated or changed response isn't counted again, and a response of an
+// earlier term is ignored.
+func TestPollCountsOnce2AA(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3, 4, 5}, 10, 1, NewMemoryStorage())
+	// campaign twice so a response of the first campaign is stale
+	r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	term := r.Term
+
+	resp := func(from, term uint64, reject bool) {
+		r.Step(pb.Message{From: from, To: 1, Term: term, MsgType: pb.MessageType_MsgRequestVoteResponse, Reject: reject})
+	}
+	check := func(name string, want map[uint64]bool) {
+		votes, vt := campaignVotes(r)
+		if vt != term || !reflect.DeepEqual(votes, want) {
+			t.Errorf("%s: votes = %v at term %d, want %v at term %d", name, votes, vt, want, term)
 		}
-		wCommit := uint64(2 + tt.successCnt) // 2 elctions
-		if sm2.RaftLog.committed != wCommit {
-			t.Fatalf("#%d: expected sm2 commit: %d, got: %d", i, wCommit, sm2.RaftLog.committed)
+	}
+	check("campaign", map[uint64]bool{1: true})
+
+	resp(2, term, false)
+	resp(2, term, false)
+	check("duplicate grant", map[uint64]bool{1: true, 2: true})
+	if g, _, res := r.TallyVotes(); g != 2 || res != VotePending {
+		t.Errorf("granted, result = %d, %v, want 2, %v", g, res, VotePending)
+	}
+
+	resp(2, term, true)
+	check("grant then reject", map[uint64]bool{1: true, 2: true})
+
+	resp(3, term-1, false)
+	check("stale term", map[uint64]bool{1: true, 2: true})
+	if r.State != StateCandidate {
+		t.Errorf("state = %v, want %v", r.State, StateCandidate)
+	}
+}
+
+// TestMsgBeatOnlyOnLeader2AA tests that MsgBeat is ignored by a follower and
+// a candidate, and makes a leader broadcast heartbeats, while a candidate
+// hearing a MsgHeartbeat of its term follows the sender.
+func TestMsgBeatOnlyOnLeader2AA(t *testing.T) {
+	for _, state := range []StateType{StateFollower, StateCandidate} {
+		r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+		if state == StateFollower {
+			r.becomeFollower(1, 2)
+		} else {
+			r.becomeCandidate()
 		}
-		if sm3.RaftLog.committed != wCommit {
-			t.Fatalf("#%d: expected sm3 commit: %d, got: %d", i, wCommit, sm3.RaftLog.committed)
+		r.readMessages()
+		term, lead, elapsed := r.Term, r.Lead, r.electionElapsed
+		r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+		if r.State != state || r.Term != term || r.Lead != lead || r.electionElapsed != elapsed {
+			t.Errorf("%v: state, term, lead, elapsed = %v, %d, %d, %d, want unchanged", state, r.State, r.Term, r.Lead, r.electionElapsed)
 		}
-
-		nt.recover()
-		nt.ignore(pb.MessageType_MsgAppend)
-		nt.send(pb.Message{From: 2, To: 2, MsgType: pb.MessageType_MsgBeat})
-		if sm1.RaftLog.committed > 1 {
-			t.Fatalf("#%d: expected sm1 commit: 1, got: %d", i, sm1.RaftLog.committed)
+		if msgs := r.readMessages(); len(msgs) != 0 {
+			t.Errorf("%v: msgs = %+v, want none", state, msgs)
 		}
 	}
-}
 
-// tests the output of the state machine when receiving MessageType_MsgBeat
-func TestRecvMessageType_MsgBeat2AA(t *testing.T) {
-	tests := []struct {
-		state StateType
-		wMsg  int
-	}{
-		{StateLeader, 2},
-		// candidate and follower should ignore MessageType_MsgBeat
-		{StateCandidate, 0},
-		{StateFollower, 0},
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgHeartbeat})
+	if r.State != StateFollower || r.Lead != 2 {
+		t.Errorf("candidate after heartbeat: state, lead = %v, %d, want %v, 2", r.State, r.Lead, StateFollower)
 	}
 
-	for i, tt := range tests {
-		sm := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r = newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+	r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+	want := []pb.Message{
+		{From: 1, To: 2, Term: 1, MsgType: pb.MessageType_MsgHeartbeat},
+		{From: 1, To: 3, Term: 1, MsgType: pb.MessageType_MsgHeartbeat},
+	}
+	if msgs := r.readMessages(); !messagesEqual(msgs, want) {
+		t.Errorf("leader msgs = %+v, want %+v", msgs, want)
+	}
+}
+
+// TestLeaderStepDownKeepsQueuedMsgs2AA tests that a leader stepping down
+// keeps the appends it queued at its old term, and handles what comes next
+// as a follower.
+func TestLeaderStepDownKeepsQueuedMsgs2AA(t *testing.T) {
+	sm := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	sm.becomeCandidate()
+	sm.becomeLeader()
+	sm.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}})
+
+	// a newer leader shows up before the broadcast is flushed
+	sm.Step(pb.Message{From: 2, To: 1, Term: 2, MsgType: pb.MessageType_MsgHeartbeat})
+	if sm.State != StateFollower || sm.Term != 2 || sm.Lead != 2 {
+		t.Fatalf("state, term, lead = %v, %d, %d, want follower, 2, 2", sm.State, sm.Term, sm.Lead)
+	}
+	if err := sm.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{}}}); err != ErrProposalDropped {
+		t.Errorf("propose = %v, want %v", err, ErrProposalDropped)
+	}
+
+	wmsgs := []pb.Message{
+		{From: 1, To: 2, Term: 1, MsgType: pb.MessageType_MsgAppend, Entries: []*pb.Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2, Data: []byte("somedata")}}},
+		{From: 1, To: 3, Term: 1, MsgType: pb.MessageType_MsgAppend, Entries: []*pb.Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2, Data: []byte("somedata")}}},
+		{From: 1, To: 2, Term: 2, MsgType: pb.MessageType_MsgHeartbeatResponse},
+	}
+	if msgs := sm.readMessages(); !messagesEqual(msgs, wmsgs) {
+		t.Errorf("msgs = %+v, want %+v", msgs, wmsgs)
+	}
+}
+
+// TestNetworkElect2AA tests that elect drives an election to a leader in a
+// healthy network, and gives up on a partitioned candidate.
+func TestNetworkElect2AA(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	if !nt.elect(1) {
+		t.Fatal("elect(1) = false, want true")
+	}
+	for id, p := range nt.peers {
+		sm := p.(*Raft)
+		if sm.Lead != 1 || sm.Term != 1 {
+			t.Errorf("peer %d: lead, term = %d, %d, want 1, 1", id, sm.Lead, sm.Term)
+		}
+	}
+
+	nt.isolate(3)
+	if nt.elect(3) {
+		t.Error("elect(3) = true, want false for an isolated candidate")
+	}
+	if sm := nt.peers[3].(*Raft); sm.State != StateCandidate {
+		t.Errorf("peer 3: state = %v, want %v", sm.State, StateCandidate)
+	}
+	if sm := nt.peers[1].(*Raft); sm.State != StateLeader {
+		t.Errorf("peer 1: state = %v, want %v", sm.State, StateLeader)
+	}
+}
+
+// TestStaleCandidateStepDown2AA tests that a voter with a higher term rejects
+// a stale vote request with its own term, and the candidate steps down to it.
+func TestStaleCandidateStepDown2AA(t *testing.T) {
+	voter := newTestRaft(2, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	voter.becomeFollower(5, None)
+	voter.Step(pb.Message{From: 1, To: 2, Term: 3, MsgType: pb.MessageType_MsgRequestVote})
+	msgs := voter.readMessages()
+	if len(msgs) != 1 {
+		t.Fatalf("len(msgs) = %d, want 1", len(msgs))
+	}
+	resp := msgs[0]
+	if resp.MsgType != pb.MessageType_MsgRequestVoteResponse || !resp.Reject || resp.Term != 5 {
+		t.Fatalf("resp = %+v, want a vote rejection at term 5", resp)
+	}
+
+	candidate := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	candidate.becomeFollower(2, None)
+	candidate.becomeCandidate()
+	if candidate.Term != 3 {
+		t.Fatalf("term = %d, want 3", candidate.Term)
+	}
+	candidate.Step(resp)
+	if candidate.State != StateFollower || candidate.Term != 5 {
+		t.Errorf("state, term = %s, %d, want %s, 5", candidate.State, candidate.Term, StateFollower)
+	}
+}
+
+// TestSendKeepsTerm2AA tests that send doesn't overwrite a term set by the
+// caller, and refuses appends not stamped with the leader's current term.
+func TestSendKeepsTerm2AA(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())
+	r.becomeFollower(5, None)
+	r.send(pb.Message{To: 2, MsgType: pb.MessageType_MsgRequestVoteResponse, Term: 7, Reject: true})
+	r.send(pb.Message{To: 2, MsgType: pb.MessageType_MsgRequestVoteResponse, Reject: true})
+	msgs := r.readMessages()
+	if len(msgs) != 2 || msgs[0].Term != 7 || msgs[1].Term != 5 {
+		t.Fatalf("msgs = %+v, want terms 7 and 5", msgs)
+	}
+
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic sending an append with a stale term")
+		}
+	}()
+	r.send(pb.Message{To: 2, MsgType: pb.MessageType_MsgAppend, Term: r.Term - 1})
+}
+
+// TestDisruptiveCandidateCheckQuorum2AA tests that with CheckQuorum a
+// partitioned node coming back with a higher term can't unseat a healthy
+// leader through vote requests, while without it the leader steps down.
+func TestDisruptiveCandidateCheckQuorum2AA(t *testing.T) {
+	for _, checkQuorum := range []bool{true, false} {
+		nt := newNetworkWithConfig(func(c *Config) { c.CheckQuorum = checkQuorum }, nil, nil, nil)
+		nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+		n1, n2, n3 := nt.peers[1].(*Raft), nt.peers[2].(*Raft), nt.peers[3].(*Raft)
+
+		// n3 keeps campaigning in a partition and inflates its term.
+		nt.isolate(3)
+		for i := 0; i < 3; i++ {
+			nt.send(pb.Message{From: 3, To: 3, MsgType: pb.MessageType_MsgHup})
+		}
+		nt.recover()
+		nt.send(pb.Message{From: 3, To: 3, MsgType: pb.MessageType_MsgHup})
+		if n3.Term != 5 {
+			t.Fatalf("checkQuorum %v: n3 term = %d, want 5", checkQuorum, n3.Term)
+		}
+
+		if checkQuorum {
+			if n1.State != StateLeader || n1.Term != 1 {
+				t.Errorf("checkQuorum: n1 state/term = %s/%d, want %s/1", n1.State, n1.Term, StateLeader)
+			}
+			if n2.Lead != 1 || n2.Term != 1 {
+				t.Errorf("checkQuorum: n2 lead/term = %d/%d, want 1/1", n2.Lead, n2.Term)
+			}
+		} else if n1.State == StateLeader && n1.Term == 1 {
+			t.Errorf("no checkQuorum: n1 is still leader at term 1")
+		}
+	}
+}
+
+// TestFreeStuckCandidateCheckQuorum2AA tests that with CheckQuorum a node
+// that inflated its term in a partition, and whose vote requests are ignored
+// within the lease, answers the leader's heartbeat with its term, so the
+// leader steps down and the node rejoins through a new election.
+func TestFreeStuckCandidateCheckQuorum2AA(t *testing.T) {
+	nt := newNetworkWithConfig(func(c *Config) { c.CheckQuorum = true }, nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	n1, n3 := nt.peers[1].(*Raft), nt.peers[3].(*Raft)
+
+	nt.isolate(3)
+	nt.send(pb.Message{From: 3, To: 3, MsgType: pb.MessageType_MsgHup})
+	nt.recover()
+	nt.send(pb.Message{From: 3, To: 3, MsgType: pb.MessageType_MsgHup})
+	if n3.State != StateCandidate || n1.State != StateLeader {
+		t.Fatalf("n1, n3 state = %s, %s, want %s, %s", n1.State, n3.State, StateLeader, StateCandidate)
+	}
+
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+	if n1.State != StateFollower || n1.Term != n3.Term {
+		t.Fatalf("n1 state/term = %s/%d, want %s/%d", n1.State, n1.Term, StateFollower, n3.Term)
+	}
+
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	if n1.State != StateLeader || n3.State != StateFollower || n3.Lead != 1 {
+		t.Errorf("n1 state = %s, n3 state/lead = %s/%d, want %s, %s/1", n1.State, n3.State, n3.Lead, StateLeader, StateFollower)
+	}
+}
+
+// TestLeaderStepDownCheckQuorum2AA tests that with CheckQuorum a leader who
+// can't hear from a quorum steps down after an election timeout.
+func TestLeaderStepDownCheckQuorum2AA(t *testing.T) {
+	nt := newNetworkWithConfig(func(c *Config) { c.CheckQuorum = true }, nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	n1 := nt.peers[1].(*Raft)
+	nt.isolate(1)
+	for i := 0; i < 2*n1.electionTimeout; i++ {
+		n1.tick()
+		nt.send(n1.readMessages()...)
+	}
+	if n1.State != StateFollower {
+		t.Errorf("state = %s, want %s", n1.State, StateFollower)
+	}
+}
+
+// TestHeartbeatRetriesKeepLease2AA tests that with CheckQuorum and heartbeat
+// retries, a leader whose every other heartbeat is lost keeps its lease,
+// while without retries it steps down.
+func TestHeartbeatRetriesKeepLease2AA(t *testing.T) {
+	for _, retries := range []int{0, 1} {
+		nt := newNetworkWithConfig(func(c *Config) {
+			c.CheckQuorum = true
+			c.HeartbeatTick = 3
+			c.HeartbeatRetries = retries
+		}, nil, nil, nil)
+		nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+		n1 := nt.peers[1].(*Raft)
+		// lose the heartbeats sent on a heartbeat tick, a retry gets through
+		nt.msgHook = func(m pb.Message) bool {
+			return m.MsgType != pb.MessageType_MsgHeartbeat || n1.heartbeatElapsed != 0
+		}
+		for i := 0; i < 3*n1.electionTimeout; i++ {
+			n1.tick()
+			nt.send(nt.filter(n1.readMessages())...)
+		}
+		if lead := n1.State == StateLeader && n1.Term == 1; lead != (retries > 0) {
+			t.Errorf("retries %d: still leader of term 1 = %v, want %v", retries, lead, retries > 0)
+		}
+	}
+}
+
+func TestHeartbeatUpdateCommit2AB(t *testing.T) {
+	log.SetLevel(log.LOG_LEVEL_ALL)
+	tests := []struct {
+		failCnt    int
+		successCnt int
+	}{
+		{1, 1},
+		{5, 3},
+		{5, 10},
+	}
+	for i, tt := range tests {
+		t.Log(i)
+		sm1 := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+		sm2 := newTestRaft(2, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+		sm3 := newTestRaft(3, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+		nt := newNetwork(sm1, sm2, sm3)
+		nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+		t.Log("send done")
+		nt.isolate(1)
+		t.Log("isolate 1")
+		// propose log to old leader should fail
+		for i := 0; i < tt.failCnt; i++ {
+			nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{}}})
+		}
+		if sm1.RaftLog.committed > 1 {
+			t.Fatalf("#%d: unexpected commit: %d", i, sm1.RaftLog.committed)
+		}
+		t.Logf("\n\n\n")
+		// propose log to cluster should success
+		nt.send(pb.Message{From: 2, To: 2, MsgType: pb.MessageType_MsgHup})
+		for i := 0; i < tt.successCnt; i++ {
+			nt.send(pb.Message{From: 2, To: 2, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{}}})
+		}
+		wCommit := uint64(2 + tt.successCnt) // 2 elctions
+		if sm2.RaftLog.committed != wCommit {
+			t.Fatalf("#%d: expected sm2 commit: %d, got: %d", i, wCommit, sm2.RaftLog.committed)
+		}
+		if sm3.RaftLog.committed != wCommit {
+			t.Fatalf("#%d: expected sm3 commit: %d, got: %d", i, wCommit, sm3.RaftLog.committed)
+		}
+
+		nt.recover()
+		nt.ignore(pb.MessageType_MsgAppend)
+		nt.send(pb.Message{From: 2, To: 2, MsgType: pb.MessageType_MsgBeat})
+		if sm1.RaftLog.committed > 1 {
+			t.Fatalf("#%d: expected sm1 commit: 1, got: %d", i, sm1.RaftLog.committed)
+		}
+	}
+}
+
+// tests the output of the state machine when receiving MessageType_MsgBeat
+func TestRecvMessageType_MsgBeat2AA(t *testing.T) {
+	tests := []struct {
+		state StateType
+		wMsg  int
+	}{
+		{StateLeader, 2},
+		// candidate and follower should ignore MessageType_MsgBeat
+		{StateCandidate, 0},
+		{StateFollower, 0},
+	}
+
+	for i, tt := range tests {
+		sm := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
 		sm.RaftLog = newLog(newMemoryStorageWithEnts([]pb.Entry{{}, {Index: 1, Term: 0}, {Index: 2, Term: 1}}))
 		sm.Term = 1
 		sm.State = tt.state
@@ -1022,6 +1810,8 @@ func TestRestoreSnapshot2C(t *testing.T) {
 	storage := NewMemoryStorage()
 	sm := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
 	sm.handleSnapshot(pb.Message{Snapshot: &s})
+	// the application persisted and applied it
+	sm.snapshotApplied(s.Metadata.Index)
 
 	if sm.RaftLog.LastIndex() != s.Metadata.Index {
 		t.Errorf("log.lastIndex = %d, want %d", sm.RaftLog.LastIndex(), s.Metadata.Index)
@@ -1059,6 +1849,768 @@ func TestRestoreIgnoreSnapshot2C(t *testing.T) {
 	}
 }
 
+// TestStaleAppendAfterSnapshot2C tests that an append older than an installed
+// snapshot leaves the log alone and is answered with the follower's commit.
+func TestStaleAppendAfterSnapshot2C(t *testing.T) {
+	sm := newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())
+	s := pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 10, Term: 1, ConfState: &pb.ConfState{Nodes: []uint64{1, 2}}}}
+	sm.Step(pb.Message{From: 2, To: 1, Term: 1, MsgType: pb.MessageType_MsgSnapshot, Snapshot: &s})
+	sm.snapshotApplied(s.Metadata.Index)
+	sm.readMessages()
+
+	// sent before the snapshot, delivered after it
+	sm.Step(pb.Message{From: 2, To: 1, Term: 1, MsgType: pb.MessageType_MsgAppend, LogTerm: 1, Index: 3, Commit: 5,
+		Entries: []*pb.Entry{{Term: 1, Index: 4}, {Term: 1, Index: 5}, {Term: 1, Index: 6}}})
+
+	l := sm.RaftLog
+	if l.start != 10 || l.LastIndex() != 10 || l.committed != 10 || len(l.allEntries()) != 0 {
+		t.Errorf("start, lastIndex, committed, len(entries) = %d, %d, %d, %d, want 10, 10, 10, 0",
+			l.start, l.LastIndex(), l.committed, len(l.allEntries()))
+	}
+	msgs := sm.readMessages()
+	if len(msgs) != 1 {
+		t.Fatalf("len(msgs) = %d, want 1", len(msgs))
+	}
+	if m := msgs[0]; m.MsgType != pb.MessageType_MsgAppendResponse || m.Reject || m.Index != 10 {
+		t.Errorf("msg = %+v, want an append response at the snapshot index 10", m)
+	}
+}
+
+// TestEmptyConfig2C tests that a node started without any configuration, as
+// a replicated peer is, doesn't campaign nor panic, and joins the group from
+// the leader's snapshot.
+func TestEmptyConfig2C(t *testing.T) {
+	sm := newTestRaft(2, nil, 10, 1, NewMemoryStorage())
+	if len(sm.Prs) != 0 {
+		t.Fatalf("prs = %v, want none", sm.Prs)
+	}
+	for i := 0; i < 2*sm.electionTimeout; i++ {
+		sm.tick()
+	}
+	sm.Step(pb.Message{From: 2, To: 2, MsgType: pb.MessageType_MsgHup})
+	if sm.State != StateFollower || sm.Term != 0 {
+		t.Fatalf("state, term = %v, %d, want %v, 0", sm.State, sm.Term, StateFollower)
+	}
+	if msgs := sm.readMessages(); len(msgs) != 0 {
+		t.Fatalf("msgs = %+v, want none", msgs)
+	}
+
+	s := pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 5, Term: 1, ConfState: &pb.ConfState{Nodes: []uint64{1, 2}}}}
+	sm.Step(pb.Message{From: 1, To: 2, Term: 1, MsgType: pb.MessageType_MsgSnapshot, Snapshot: &s})
+	sm.snapshotApplied(s.Metadata.Index)
+	if !reflect.DeepEqual(nodes(sm), []uint64{1, 2}) {
+		t.Errorf("nodes = %v, want [1 2]", nodes(sm))
+	}
+	if sm.Lead != 1 || sm.RaftLog.committed != 5 {
+		t.Errorf("lead, committed = %d, %d, want 1, 5", sm.Lead, sm.RaftLog.committed)
+	}
+}
+
+// TestSnapshotProgress2C tests that installing a snapshot rebuilds the
+// progress of the peers from it, and that a leader ignores a snapshot.
+func TestSnapshotProgress2C(t *testing.T) {
+	s := pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 11, Term: 11, ConfState: &pb.ConfState{Nodes: []uint64{1, 2, 3}}}}
+
+	sm := newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())
+	sm.Step(pb.Message{From: 2, To: 1, Term: 11, MsgType: pb.MessageType_MsgSnapshot, Snapshot: &s})
+	if len(sm.Prs) != 3 {
+		t.Fatalf("len(prs) = %d, want 3", len(sm.Prs))
+	}
+	for id, pr := range sm.Prs {
+		if pr.Match != 0 || pr.Next != 12 {
+			t.Errorf("prs[%d] = {match %d next %d}, want {match 0 next 12}", id, pr.Match, pr.Next)
+		}
+	}
+
+	lead := newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())
+	lead.becomeCandidate()
+	lead.becomeLeader()
+	lead.readMessages()
+	lastIndex := lead.RaftLog.LastIndex()
+	lead.Step(pb.Message{From: 2, To: 1, Term: lead.Term, MsgType: pb.MessageType_MsgSnapshot, Snapshot: &s})
+	if lead.State != StateLeader || lead.RaftLog.LastIndex() != lastIndex || lead.RaftLog.pendingSnapshot != nil || len(lead.Prs) != 2 {
+		t.Errorf("leader installed the snapshot: state %v, lastIndex %d, prs %d", lead.State, lead.RaftLog.LastIndex(), len(lead.Prs))
+	}
+	if msgs := lead.readMessages(); len(msgs) != 0 {
+		t.Errorf("msgs = %+v, want none", msgs)
+	}
+}
+
+// TestAnyFollowerNeedsSnapshot2C tests that a leader reports a follower
+// whose next entry follows a compacted one, and not one it can append to.
+func TestAnyFollowerNeedsSnapshot2C(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 10, Term: 1, ConfState: &pb.ConfState{Nodes: []uint64{1, 2, 3}}}})
+	storage.Append([]pb.Entry{{Index: 11, Term: 1}, {Index: 12, Term: 1}})
+	sm := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, storage)
+	if sm.anyFollowerNeedsSnapshot() {
+		t.Errorf("follower needs snapshot = true, want false")
+	}
+	sm.becomeCandidate()
+	sm.becomeLeader()
+
+	tests := []struct {
+		next2, next3 uint64
+		w            bool
+	}{
+		{13, 14, false},
+		// the previous entry is the snapshot index
+		{11, 14, false},
+		{14, 10, true},
+		{1, 1, true},
+	}
+	for i, tt := range tests {
+		sm.Prs[2].Next, sm.Prs[3].Next = tt.next2, tt.next3
+		if g := sm.anyFollowerNeedsSnapshot(); g != tt.w {
+			t.Errorf("#%d: needs snapshot = %v, want %v", i, g, tt.w)
+		}
+	}
+}
+
+// TestAppendAfterSnapshot2C tests that an append whose previous entry is the
+// snapshot index matches the snapshot term, and its entries follow it.
+func TestAppendAfterSnapshot2C(t *testing.T) {
+	sm := newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())
+	s := pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 100, Term: 7, ConfState: &pb.ConfState{Nodes: []uint64{1, 2}}}}
+	sm.Step(pb.Message{From: 2, To: 1, Term: 7, MsgType: pb.MessageType_MsgSnapshot, Snapshot: &s})
+	sm.snapshotApplied(s.Metadata.Index)
+	sm.readMessages()
+
+	var ents []*pb.Entry
+	for i := uint64(101); i <= 105; i++ {
+		ents = append(ents, &pb.Entry{Term: 7, Index: i})
+	}
+	sm.Step(pb.Message{From: 2, To: 1, Term: 7, MsgType: pb.MessageType_MsgAppend, Index: 100, LogTerm: 7, Commit: 103, Entries: ents})
+
+	msgs := sm.readMessages()
+	if len(msgs) != 1 || msgs[0].Reject || msgs[0].Index != 105 {
+		t.Fatalf("msgs = %+v, want an accept of 105", msgs)
+	}
+	if g := sm.RaftLog.LastIndex(); g != 105 {
+		t.Errorf("lastIndex = %d, want 105", g)
+	}
+	if g := sm.RaftLog.committed; g != 103 {
+		t.Errorf("committed = %d, want 103", g)
+	}
+	if e, err := sm.RaftLog.entryAt(101); err != nil || e.Term != 7 {
+		t.Errorf("entryAt(101) = %+v, %v, want term 7", e, err)
+	}
+}
+
+// TestSnapshotDummyTerm2C tests that the term of the snapshot index is the
+// snapshot's term, after installing it and after restarting from it.
+func TestSnapshotDummyTerm2C(t *testing.T) {
+	storage := NewMemoryStorage()
+	for i := uint64(1); i <= 50; i++ {
+		storage.Append([]pb.Entry{{Term: 3, Index: i}})
+	}
+	sm := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+	s := pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 100, Term: 7, ConfState: &pb.ConfState{Nodes: []uint64{1, 2}}}}
+	sm.Step(pb.Message{From: 2, To: 1, Term: 7, MsgType: pb.MessageType_MsgSnapshot, Snapshot: &s})
+	sm.snapshotApplied(s.Metadata.Index)
+
+	check := func(name string, l *RaftLog) {
+		if term, err := l.Term(100); err != nil || term != 7 {
+			t.Errorf("%s: term(100) = %d, %v, want 7, nil", name, term, err)
+		}
+		if e, err := l.entryAt(100); err != nil || e.Index != 100 || e.Term != 7 {
+			t.Errorf("%s: entryAt(100) = %+v, %v, want {index 100 term 7}", name, e, err)
+		}
+		if l.LastIndex() != 100 || l.LastTerm() != 7 {
+			t.Errorf("%s: last index, term = %d, %d, want 100, 7", name, l.LastIndex(), l.LastTerm())
+		}
+	}
+	check("installed", sm.RaftLog)
+
+	restarted := NewMemoryStorage()
+	restarted.ApplySnapshot(s)
+	check("restarted", newTestRaft(1, nil, 10, 1, restarted).RaftLog)
+}
+
+// TestHandleStaleSnapshot2C tests that a follower answers a snapshot at or
+// below its commit with its commit index, and leaves its state untouched.
+func TestHandleStaleSnapshot2C(t *testing.T) {
+	storage := NewMemoryStorage()
+	for i := uint64(1); i <= 10; i++ {
+		storage.Append([]pb.Entry{{Term: 1, Index: i}})
+	}
+	sm := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+	sm.becomeFollower(2, 2)
+	sm.RaftLog.committed = 10
+
+	s := pb.Snapshot{
+		Metadata: &pb.SnapshotMetadata{
+			Index:     5,
+			Term:      1,
+			ConfState: &pb.ConfState{Nodes: []uint64{1, 2, 3}},
+		},
+	}
+	sm.Step(pb.Message{From: 2, To: 1, Term: 2, MsgType: pb.MessageType_MsgSnapshot, Snapshot: &s})
+
+	if sm.RaftLog.committed != 10 || sm.RaftLog.LastIndex() != 10 || sm.RaftLog.start != 0 {
+		t.Errorf("committed, lastIndex, start = %d, %d, %d, want 10, 10, 0",
+			sm.RaftLog.committed, sm.RaftLog.LastIndex(), sm.RaftLog.start)
+	}
+	if sm.RaftLog.pendingSnapshot != nil {
+		t.Errorf("pendingSnapshot = %+v, want nil", sm.RaftLog.pendingSnapshot)
+	}
+	if w, g := []uint64{1, 2}, nodes(sm); !reflect.DeepEqual(g, w) {
+		t.Errorf("nodes = %v, want %v", g, w)
+	}
+	msgs := sm.readMessages()
+	if len(msgs) != 1 {
+		t.Fatalf("len(msgs) = %d, want 1", len(msgs))
+	}
+	if m := msgs[0]; m.MsgType != pb.MessageType_MsgAppendResponse || m.To != 2 || m.Reject || m.Index != 10 {
+		t.Errorf("msg = %+v, want an accepted append response at index 10", m)
+	}
+}
+
+// TestRestoreConfigSnapshot2C tests that a config snapshot only rebuilds the
+// membership of a node that still has its log, and keeps the entries as-is.
+func TestRestoreConfigSnapshot2C(t *testing.T) {
+	ents := make([]pb.Entry, 0, 10)
+	for i := uint64(1); i <= 10; i++ {
+		ents = append(ents, pb.Entry{Term: 1, Index: i, Data: []byte("somedata")})
+	}
+	leader := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	leader.RaftLog.append(ents...)
+	leader.RaftLog.committed = 8
+	s := leader.configSnapshot()
+	if len(s.Data) != 0 || s.Metadata.Index != 8 || s.Metadata.Term != 1 {
+		t.Fatalf("config snapshot = %+v, want no data at index 8 term 1", s)
+	}
+
+	storage := NewMemoryStorage()
+	storage.Append(ents)
+	sm := newTestRaft(2, []uint64{2}, 10, 1, storage)
+	sm.RaftLog.committed = 3
+	sm.Step(pb.Message{From: 1, To: 2, Term: 1, MsgType: pb.MessageType_MsgSnapshot, Snapshot: &s})
+
+	if g := nodes(sm); !reflect.DeepEqual(g, []uint64{1, 2, 3}) {
+		t.Errorf("nodes = %v, want [1 2 3]", g)
+	}
+	if !reflect.DeepEqual(sm.RaftLog.allEntries(), ents) {
+		t.Errorf("entries = %+v, want %+v", sm.RaftLog.allEntries(), ents)
+	}
+	if sm.RaftLog.start != 0 || sm.RaftLog.committed != 8 {
+		t.Errorf("start, committed = %d, %d, want 0, 8", sm.RaftLog.start, sm.RaftLog.committed)
+	}
+	if sm.RaftLog.pendingSnapshot != nil {
+		t.Errorf("pendingSnapshot = %+v, want nil", sm.RaftLog.pendingSnapshot)
+	}
+	msgs := sm.readMessages()
+	if len(msgs) != 1 {
+		t.Fatalf("len(msgs) = %d, want 1", len(msgs))
+	}
+	if m := msgs[0]; m.MsgType != pb.MessageType_MsgAppendResponse || m.Reject || m.Index != 8 {
+		t.Errorf("msg = %+v, want an accepted append response at index 8", m)
+	}
+}
+
+// TestRestoreBootstrap2C tests that a fresh node can be bootstrapped directly
+// from a snapshot, and an older snapshot is refused afterwards.
+func TestRestoreBootstrap2C(t *testing.T) {
+	s := pb.Snapshot{
+		Metadata: &pb.SnapshotMetadata{
+			Index:     1000,
+			Term:      5,
+			ConfState: &pb.ConfState{Nodes: []uint64{1, 2, 3}},
+		},
+	}
+	sm := newTestRaft(1, []uint64{1}, 10, 1, NewMemoryStorage())
+	if !sm.restore(s) {
+		t.Fatal("restore = false, want true")
+	}
+
+	l := sm.RaftLog
+	if l.committed != 1000 || l.applied != 1000 || l.stabled != 1000 || l.start != 1000 {
+		t.Errorf("committed/applied/stabled/start = %d/%d/%d/%d, want 1000/1000/1000/1000",
+			l.committed, l.applied, l.stabled, l.start)
+	}
+	if l.LastIndex() != 1000 {
+		t.Errorf("lastIndex = %d, want 1000", l.LastIndex())
+	}
+	if term := mustTerm(l.Term(1000)); term != 5 {
+		t.Errorf("term = %d, want 5", term)
+	}
+	if g := nodes(sm); !reflect.DeepEqual(g, s.Metadata.ConfState.Nodes) {
+		t.Errorf("nodes = %v, want %v", g, s.Metadata.ConfState.Nodes)
+	}
+
+	old := pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 999, Term: 5, ConfState: &pb.ConfState{Nodes: []uint64{1}}}}
+	if sm.restore(old) {
+		t.Fatal("restore old snapshot = true, want false")
+	}
+	if g := nodes(sm); !reflect.DeepEqual(g, s.Metadata.ConfState.Nodes) {
+		t.Errorf("nodes = %v, want %v", g, s.Metadata.ConfState.Nodes)
+	}
+}
+
+// TestForEachCommitted2C tests that forEachCommitted visits the same entries
+// as nextEnts in order, across a compacted log, and stops when asked.
+func TestForEachCommitted2C(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 3, Term: 1, ConfState: &pb.ConfState{Nodes: []uint64{1}}}})
+	storage.Append([]pb.Entry{{Term: 1, Index: 4}, {Term: 1, Index: 5}, {Term: 2, Index: 6}, {Term: 2, Index: 7}, {Term: 2, Index: 8}})
+	storage.SetHardState(pb.HardState{Term: 2, Commit: 7})
+
+	tests := []struct {
+		applied uint64
+		stop    int // stop after this many entries, 0 to visit all
+	}{
+		{0, 0},
+		{4, 0},
+		{7, 0},
+		{0, 2},
+	}
+	for i, tt := range tests {
+		c := newTestConfig(1, nil, 10, 1, storage)
+		c.Applied = tt.applied
+		l := newRaft(c).RaftLog
+
+		want := l.nextEnts()
+		if tt.stop > 0 {
+			want = want[:tt.stop]
+		}
+		var got []pb.Entry
+		l.forEachCommitted(func(e *pb.Entry) bool {
+			got = append(got, *e)
+			return len(got) != tt.stop
+		})
+		if len(got) != len(want) || len(want) != 0 && !reflect.DeepEqual(got, want) {
+			t.Errorf("#%d: visited %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+// TestUncommittedEntries2AB tests that uncommittedEntries returns a copy of
+// the log tail above committed.
+func TestUncommittedEntries2AB(t *testing.T) {
+	tests := []struct {
+		committed uint64
+		wents     []pb.Entry
+	}{
+		{1, []pb.Entry{{Index: 2, Term: 1}, {Index: 3, Term: 2}}},
+		{2, []pb.Entry{{Index: 3, Term: 2}}},
+		{3, []pb.Entry{}},
+	}
+	for i, tt := range tests {
+		storage := NewMemoryStorage()
+		storage.Append([]pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 2}})
+		l := newLog(storage)
+		l.committed = tt.committed
+
+		ents := l.uncommittedEntries()
+		if !reflect.DeepEqual(ents, tt.wents) {
+			t.Errorf("#%d: ents = %+v, want %+v", i, ents, tt.wents)
+		}
+		if len(ents) > 0 {
+			ents[0].Term = 9
+			if term := mustTerm(l.Term(ents[0].Index)); term == 9 {
+				t.Errorf("#%d: modifying the result changed the log", i)
+			}
+		}
+	}
+}
+
+// TestConfigValidateTicks2AA tests that validate rejects tick configurations
+// whose election timeout is too close to the heartbeat interval.
+func TestConfigValidateTicks2AA(t *testing.T) {
+	tests := []struct {
+		election, heartbeat int
+		wok                 bool
+	}{
+		{10, 1, true},
+		{3, 1, true},
+		{6, 2, true},
+		{0, 0, false},
+		{2, 1, false},
+		{5, 2, false},
+		{2, 2, false},
+		{1, 2, false},
+	}
+	for i, tt := range tests {
+		c := newTestConfig(1, []uint64{1}, tt.election, tt.heartbeat, NewMemoryStorage())
+		if err := c.validate(); (err == nil) != tt.wok {
+			t.Errorf("#%d: validate(%d, %d) = %v, want ok %v", i, tt.election, tt.heartbeat, err, tt.wok)
+		}
+	}
+}
+
+// TestElapsedBounded2AA tests that the clocks of a long running leader and
+// follower never grow past their timeouts, and StrictSafety never aborts.
+func TestElapsedBounded2AA(t *testing.T) {
+	defer log.SetLevel(log.GetLogLevel())
+	log.SetLevel(log.LOG_LEVEL_ERROR)
+
+	var reasons []string
+	newStrictRaft := func(id uint64, peers []uint64) *Raft {
+		cfg := newTestConfig(id, peers, 10, 1, NewMemoryStorage())
+		cfg.StrictSafety = true
+		cfg.AbortHook = func(reason string) { reasons = append(reasons, reason) }
+		return newRaft(cfg)
+	}
+	leader := newStrictRaft(1, []uint64{1, 2})
+	leader.becomeCandidate()
+	leader.becomeLeader()
+	// a follower in a group it isn't part of never gets to campaign
+	follower := newStrictRaft(2, []uint64{1})
+
+	for i := 0; i < 1000000; i++ {
+		for _, r := range []*Raft{leader, follower} {
+			r.tick()
+			r.readMessages()
+			if r.electionElapsed > r.randomizedElectionTimeout || r.heartbeatElapsed > r.heartbeatTimeout {
+				t.Fatalf("%x tick %d: electionElapsed, heartbeatElapsed = %d, %d, want <= %d, %d", r.id, i,
+					r.electionElapsed, r.heartbeatElapsed, r.randomizedElectionTimeout, r.heartbeatTimeout)
+			}
+		}
+	}
+	if leader.State != StateLeader {
+		t.Errorf("state = %v, want %v", leader.State, StateLeader)
+	}
+	if len(reasons) != 0 {
+		t.Errorf("aborted: %v", reasons)
+	}
+}
+
+// TestRandN2AA tests that randN stays in [0,n) and returns 0 for n <= 0.
+func TestRandN2AA(t *testing.T) {
+	maxInt := int(^uint(0) >> 1)
+	for _, n := range []int{1, 2, 10, maxInt} {
+		for i := 0; i < 1000; i++ {
+			if g := randN(n); g < 0 || g >= n {
+				t.Fatalf("randN(%d) = %d, want in [0,%d)", n, g, n)
+			}
+		}
+	}
+	for _, n := range []int{0, -1} {
+		if g := randN(n); g != 0 {
+			t.Errorf("randN(%d) = %d, want 0", n, g)
+		}
+	}
+}
+
+// TestConfigApplied2C tests that Config.Applied moves applied past the
+// snapshot on restart, and is refused outside [snapshot, committed].
+func TestConfigApplied2C(t *testing.T) {
+	tests := []struct {
+		applied uint64
+
+		wapplied uint64
+		wpanic   bool
+	}{
+		// not set, applied starts at the snapshot
+		{0, 3, false},
+		{3, 3, false},
+		{4, 4, false},
+		{6, 6, false},
+		{2, 0, true},
+		{7, 0, true},
+	}
+	for i, tt := range tests {
+		storage := NewMemoryStorage()
+		storage.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 3, Term: 1, ConfState: &pb.ConfState{Nodes: []uint64{1}}}})
+		storage.Append([]pb.Entry{{Index: 4, Term: 1}, {Index: 5, Term: 1}, {Index: 6, Term: 1}, {Index: 7, Term: 1}})
+		storage.SetHardState(pb.HardState{Term: 1, Commit: 6})
+		c := newTestConfig(1, nil, 10, 1, storage)
+		c.Applied = tt.applied
+
+		func() {
+			defer func() {
+				if r := recover(); (r != nil) != tt.wpanic {
+					t.Errorf("#%d: panic = %v, want panic %v", i, r, tt.wpanic)
+				}
+			}()
+			r := newRaft(c)
+			if r.RaftLog.applied != tt.wapplied {
+				t.Errorf("#%d: applied = %d, want %d", i, r.RaftLog.applied, tt.wapplied)
+			}
+		}()
+	}
+}
+
+// crashStorage returns a storage holding what a node had persisted when it
+// crashed: an optional snapshot, the entries after it and the HardState.
+func crashStorage(snap *pb.Snapshot, ents []pb.Entry, hs pb.HardState) *MemoryStorage {
+	storage := NewMemoryStorage()
+	if snap != nil {
+		storage.ApplySnapshot(*snap)
+	}
+	storage.Append(ents)
+	storage.SetHardState(hs)
+	return storage
+}
+
+// recoveredState is what a node should come up with after replaying its
+// storage.
+type recoveredState struct {
+	committed, applied, lastIndex uint64
+	prs                           map[uint64]Progress
+}
+
+// checkRecovered restarts a node from storage the way newRaft does after a
+// crash, and compares the recovered state against want.
+func checkRecovered(t *testing.T, name string, storage Storage, peers []uint64, applied uint64, want recoveredState) {
+	c := newTestConfig(1, peers, 10, 1, storage)
+	c.Applied = applied
+	r := newRaft(c)
+
+	l := r.RaftLog
+	if l.committed != want.committed || l.applied != want.applied || l.LastIndex() != want.lastIndex {
+		t.Errorf("%s: committed/applied/lastIndex = %d/%d/%d, want %d/%d/%d", name,
+			l.committed, l.applied, l.LastIndex(), want.committed, want.applied, want.lastIndex)
+	}
+	if l.stabled != l.LastIndex() {
+		t.Errorf("%s: stabled = %d, want %d", name, l.stabled, l.LastIndex())
+	}
+	prs := make(map[uint64]Progress, len(r.Prs))
+	for id, pr := range r.Prs {
+		prs[id] = Progress{Match: pr.Match, Next: pr.Next}
+	}
+	if !reflect.DeepEqual(prs, want.prs) {
+		t.Errorf("%s: prs = %+v, want %+v", name, prs, want.prs)
+	}
+}
+
+// TestCrashRecovery2C tests that a node restarted from its storage recovers
+// its log and configuration as they were persisted.
+func TestCrashRecovery2C(t *testing.T) {
+	snap := &pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 5, Term: 2, ConfState: &pb.ConfState{Nodes: []uint64{1, 2, 3}}}}
+	tail := []pb.Entry{{Index: 6, Term: 2}, {Index: 7, Term: 3}, {Index: 8, Term: 3}}
+
+	// nothing but a committed log
+	checkRecovered(t, "log",
+		crashStorage(nil, []pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}}, pb.HardState{Term: 1, Commit: 2}),
+		[]uint64{1, 2}, 0,
+		recoveredState{2, 0, 2, map[uint64]Progress{1: {Match: 0, Next: 3}, 2: {Match: 0, Next: 3}}})
+	// the snapshot has the configuration, the peers in Config are ignored
+	checkRecovered(t, "snapshot",
+		crashStorage(snap, nil, pb.HardState{Term: 2, Commit: 5}),
+		[]uint64{1}, 0,
+		recoveredState{5, 5, 5, map[uint64]Progress{1: {Match: 5, Next: 6}, 2: {Match: 0, Next: 6}, 3: {Match: 0, Next: 6}}})
+	// the HardState wasn't saved after the snapshot was applied
+	checkRecovered(t, "snapshot without hardstate",
+		crashStorage(snap, nil, pb.HardState{}),
+		nil, 0,
+		recoveredState{5, 5, 5, map[uint64]Progress{1: {Match: 5, Next: 6}, 2: {Match: 0, Next: 6}, 3: {Match: 0, Next: 6}}})
+	// uncommitted tail stays in the log, but isn't committed
+	checkRecovered(t, "uncommitted tail",
+		crashStorage(snap, tail, pb.HardState{Term: 3, Commit: 6}),
+		nil, 0,
+		recoveredState{6, 5, 8, map[uint64]Progress{1: {Match: 5, Next: 9}, 2: {Match: 0, Next: 9}, 3: {Match: 0, Next: 9}}})
+	// Config.Applied moves applied past the snapshot
+	checkRecovered(t, "applied",
+		crashStorage(snap, tail, pb.HardState{Term: 3, Commit: 7}),
+		nil, 7,
+		recoveredState{7, 7, 8, map[uint64]Progress{1: {Match: 5, Next: 9}, 2: {Match: 0, Next: 9}, 3: {Match: 0, Next: 9}}})
+
+	// a commit past the log means entries were lost
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("lost entries: want panic")
+			}
+		}()
+		newTestRaft(1, nil, 10, 1, crashStorage(snap, tail, pb.HardState{Term: 3, Commit: 9}))
+	}()
+}
+
+// TestUnstableEntries2AA tests that unstableEntries returns the tail after
+// stabled on a fresh log, with unstable entries, after a snapshot and after a
+// truncate.
+func TestUnstableEntries2AA(t *testing.T) {
+	newTestLog := func() *RaftLog {
+		storage := NewMemoryStorage()
+		storage.Append([]pb.Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2}, {Term: 1, Index: 3}})
+		l := newLog(storage)
+		l.append(pb.Entry{Term: 2, Index: 4}, pb.Entry{Term: 2, Index: 5})
+		return l
+	}
+	tests := []struct {
+		name string
+		l    *RaftLog
+		want []uint64
+	}{
+		{"fresh", newLog(NewMemoryStorage()), nil},
+		{"unstable", newTestLog(), []uint64{4, 5}},
+		{"snapshot past the log", func() *RaftLog { l := newTestLog(); l.cutDown(7, 2); return l }(), nil},
+		{"snapshot in the unstable tail", func() *RaftLog { l := newTestLog(); l.cutDown(4, 2); return l }(), []uint64{5}},
+		{"truncate the unstable tail", func() *RaftLog { l := newTestLog(); l.truncate(4); return l }(), nil},
+		{"truncate the stable log", func() *RaftLog {
+			l := newTestLog()
+			l.stabled = 5
+			l.truncate(3)
+			l.append(pb.Entry{Term: 3, Index: 3})
+			return l
+		}(), []uint64{3}},
+	}
+	for _, tt := range tests {
+		var g []uint64
+		for _, e := range tt.l.unstableEntries() {
+			g = append(g, e.Index)
+		}
+		if !reflect.DeepEqual(g, tt.want) {
+			t.Errorf("%s: unstable = %v, want %v", tt.name, g, tt.want)
+		}
+	}
+}
+
+// TestDescribe2AB tests the report of a leader with a lagging, paused peer.
+func TestDescribe2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	nt.isolate(3)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("x")}}})
+	lead := nt.peers[1].(*Raft)
+	lead.Prs[3].ReplicationPaused = true
+	lead.leadTransferee = 2
+
+	want := `raft 1: StateLeader term 1 vote 1 lead 1
+log: first 1 last 2 commit 2 applied 0 stabled 0
+pending conf index 0 transferee 2
+peer 1: match 2 next 3 commit 0 active false
+peer 2: match 2 next 3 commit 2 active true
+peer 3: match 1 next 2 commit 1 active true paused
+`
+	if g := lead.Describe(); g != want {
+		t.Errorf("describe =\n%s\nwant\n%s", g, want)
+	}
+}
+
+// TestForceCompact2C tests that forcing compaction discards the entries in
+// memory up to applied whatever the storage kept, that the entries above
+// still read and apply, and that an index out of range is refused.
+func TestForceCompact2C(t *testing.T) {
+	storage := NewMemoryStorage()
+	for j := uint64(1); j <= 10; j++ {
+		storage.Append([]pb.Entry{{Index: j, Term: 1, Data: []byte("somedata")}})
+	}
+	l := newLog(storage)
+	l.committed = 10
+	l.applied = 6
+
+	if err := l.forceCompact(7); err == nil {
+		t.Errorf("force compact above applied: err = nil, want an error")
+	}
+	// applied ahead of stabled with AsyncApply, 6 isn't persisted yet
+	l.stabled = 5
+	if err := l.forceCompact(6); err == nil {
+		t.Errorf("force compact above stabled: err = nil, want an error")
+	}
+	l.stabled = 10
+	if err := l.forceCompact(6); err != nil {
+		t.Fatal(err)
+	}
+	if l.start != 6 || len(l.allEntries()) != 4 || l.dataSize != 4*8 {
+		t.Errorf("start, len(entries), dataSize = %d, %d, %d, want 6, 4, 32", l.start, len(l.allEntries()), l.dataSize)
+	}
+	if term, err := l.Term(6); err != nil || term != 1 {
+		t.Errorf("Term(6) = %d, %v, want 1, nil", term, err)
+	}
+	if _, err := l.entryAt(5); err != ErrCompacted {
+		t.Errorf("entryAt(5) err = %v, want %v", err, ErrCompacted)
+	}
+	if ents := l.nextEnts(); len(ents) != 4 || ents[0].Index != 7 {
+		t.Errorf("nextEnts = %+v, want 7 to 10", ents)
+	}
+	if err := l.forceCompact(5); err != ErrCompacted {
+		t.Errorf("force compact below first: err = %v, want %v", err, ErrCompacted)
+	}
+}
+
+// TestCompactRetainEntries2C tests that compaction keeps the configured
+// number of entries below applied, but never more than the storage has.
+func TestCompactRetainEntries2C(t *testing.T) {
+	tests := []struct {
+		retain  uint64
+		compact uint64
+		applied uint64
+
+		wstart uint64
+	}{
+		{0, 8, 8, 7},
+		{3, 8, 8, 4},
+		// the storage keeps more
+		{3, 2, 8, 2},
+		// fewer applied than retained
+		{3, 8, 3, 0},
+		{3, 8, 4, 0},
+		{3, 8, 5, 1},
+	}
+	for i, tt := range tests {
+		storage := NewMemoryStorage()
+		for j := uint64(1); j <= 10; j++ {
+			storage.Append([]pb.Entry{{Index: j, Term: 1}})
+		}
+		c := newTestConfig(1, []uint64{1}, 10, 1, storage)
+		c.CompactionRetainEntries = tt.retain
+		l := newRaft(c).RaftLog
+		l.committed = 10
+		l.applied = tt.applied
+		if err := storage.Compact(tt.compact); err != nil {
+			t.Fatal(err)
+		}
+		l.maybeCompact()
+
+		if l.start != tt.wstart {
+			t.Errorf("#%d: start = %d, want %d", i, l.start, tt.wstart)
+		}
+		if g := uint64(len(l.allEntries())); g != 10-tt.wstart {
+			t.Errorf("#%d: len(entries) = %d, want %d", i, g, 10-tt.wstart)
+		}
+	}
+}
+
+// TestCompactKeepApplied2C tests that compaction follows the storage but never
+// discards the entry at applied.
+func TestCompactKeepApplied2C(t *testing.T) {
+	tests := []struct {
+		compact uint64
+		applied uint64
+
+		wstart uint64
+	}{
+		// storage compacted below applied
+		{3, 5, 3},
+		// storage compacted past applied, keep the entry at applied
+		{8, 5, 4},
+		{5, 5, 4},
+		// nothing applied yet
+		{8, 0, 0},
+	}
+	for i, tt := range tests {
+		storage := NewMemoryStorage()
+		for j := uint64(1); j <= 10; j++ {
+			storage.Append([]pb.Entry{{Index: j, Term: 1, Data: []byte("data")}})
+		}
+		l := newLog(storage)
+		l.committed = 10
+		l.applied = tt.applied
+		if err := storage.Compact(tt.compact); err != nil {
+			t.Fatal(err)
+		}
+		l.maybeCompact()
+
+		if l.start != tt.wstart {
+			t.Errorf("#%d: start = %d, want %d", i, l.start, tt.wstart)
+		}
+		if tt.applied != 0 {
+			e, err := l.entryAt(tt.applied)
+			if err != nil || e.Index != tt.applied || e.Data == nil {
+				t.Errorf("#%d: entry at applied = %+v, %v, want index %d with data", i, e, err, tt.applied)
+			}
+		}
+		if l.LastIndex() != 10 {
+			t.Errorf("#%d: lastIndex = %d, want 10", i, l.LastIndex())
+		}
+		if term := mustTerm(l.Term(l.start)); tt.wstart != 0 && term != 1 {
+			t.Errorf("#%d: term(%d) = %d, want 1", i, l.start, term)
+		}
+	}
+}
+
 func TestProvideSnap2C(t *testing.T) {
 	// restore the state machine from a snapshot so it has a compacted log and a snapshot
 	s := pb.Snapshot{
@@ -1071,6 +2623,7 @@ func TestProvideSnap2C(t *testing.T) {
 	storage := NewMemoryStorage()
 	sm := newTestRaft(1, []uint64{1}, 10, 1, storage)
 	sm.handleSnapshot(pb.Message{Snapshot: &s})
+	sm.snapshotApplied(s.Metadata.Index)
 
 	sm.becomeCandidate()
 	sm.becomeLeader()
@@ -1090,6 +2643,39 @@ func TestProvideSnap2C(t *testing.T) {
 	}
 }
 
+// TestSnapshotAckResumesAppend2C tests that once a follower acks the snapshot
+// sent to it, the leader goes on appending the entries after the snapshot.
+func TestSnapshotAckResumesAppend2C(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 5, Term: 1, ConfState: &pb.ConfState{Nodes: []uint64{1, 2, 3}}}})
+	storage.Append([]pb.Entry{{Term: 1, Index: 6}, {Term: 1, Index: 7}, {Term: 1, Index: 8}})
+	storage.SetHardState(pb.HardState{Term: 1, Commit: 8})
+	sm := newTestRaft(1, nil, 10, 1, storage)
+	sm.becomeCandidate()
+	sm.becomeLeader()
+	sm.readMessages()
+
+	// node 2 is behind the snapshot
+	sm.Prs[2].Next = 5
+	sm.sendAppend(2)
+	msgs := sm.readMessages()
+	if len(msgs) != 1 || msgs[0].MsgType != pb.MessageType_MsgSnapshot {
+		t.Fatalf("msgs = %+v, want a snapshot", msgs)
+	}
+	if g := sm.Prs[2].PendingSnapshot; g != 5 {
+		t.Errorf("pendingSnapshot = %d, want 5", g)
+	}
+
+	sm.Step(pb.Message{From: 2, To: 1, Term: sm.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: 5})
+	if g := sm.Prs[2].PendingSnapshot; g != 0 {
+		t.Errorf("pendingSnapshot after ack = %d, want 0", g)
+	}
+	msgs = sm.readMessages()
+	if len(msgs) != 1 || msgs[0].MsgType != pb.MessageType_MsgAppend || msgs[0].Index != 5 || len(msgs[0].Entries) != 4 {
+		t.Fatalf("msgs = %+v, want an append of 6..9 after 5", msgs)
+	}
+}
+
 func TestRestoreFromSnapMsg2C(t *testing.T) {
 	s := pb.Snapshot{
 		Metadata: &pb.SnapshotMetadata{
@@ -1179,21 +2765,637 @@ func TestAddNode3A(t *testing.T) {
 	}
 }
 
-// TestRemoveNode tests that removeNode could update nodes and
-// and removed list correctly.
-func TestRemoveNode3A(t *testing.T) {
-	r := newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())
-	r.removeNode(2)
-	w := []uint64{1}
-	if g := nodes(r); !reflect.DeepEqual(g, w) {
-		t.Errorf("nodes = %v, want %v", g, w)
+// TestRemoveNode tests that removeNode could update nodes and
+// and removed list correctly.
+func TestRemoveNode3A(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())
+	r.removeNode(2)
+	w := []uint64{1}
+	if g := nodes(r); !reflect.DeepEqual(g, w) {
+		t.Errorf("nodes = %v, want %v", g, w)
+	}
+
+	// remove all nodes from cluster
+	r.removeNode(1)
+	w = []uint64{}
+	if g := nodes(r); !reflect.DeepEqual(g, w) {
+		t.Errorf("nodes = %v, want %v", g, w)
+	}
+}
+
+// TestConfChangeReapply3A tests that applying the same conf change twice,
+// e.g. replayed after a snapshot that already reflects it, is a no-op.
+func TestConfChangeReapply3A(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.Prs[2].Match = 1
+
+	r.addNode(3)
+	r.Prs[3].Match = 1
+	r.addNode(3)
+	w := []uint64{1, 2, 3}
+	if g := nodes(r); !reflect.DeepEqual(g, w) {
+		t.Errorf("nodes = %v, want %v", g, w)
+	}
+	if len(r.peers) != 3 {
+		t.Errorf("peers = %v, want %v", r.peers, w)
+	}
+	// the second add must not reset the progress
+	if m := r.Prs[3].Match; m != 1 {
+		t.Errorf("match = %d, want 1", m)
+	}
+
+	r.removeNode(3)
+	r.removeNode(3)
+	w = []uint64{1, 2}
+	if g := nodes(r); !reflect.DeepEqual(g, w) {
+		t.Errorf("nodes = %v, want %v", g, w)
+	}
+	if len(r.peers) != 2 {
+		t.Errorf("peers = %v, want %v", r.peers, w)
+	}
+}
+
+// TestProbeAfterElection2AB tests that with ProbeAfterElection a new leader
+// sends empty appends until a follower accepts one, and only then the entries.
+func TestProbeAfterElection2AB(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Append([]pb.Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2}})
+	storage.SetHardState(pb.HardState{Term: 1})
+	cfg := newTestConfig(1, []uint64{1, 2, 3}, 10, 1, storage)
+	cfg.ProbeAfterElection = true
+	sm := newRaft(cfg)
+	sm.becomeCandidate()
+	sm.becomeLeader()
+	sm.bcastAppend(false)
+
+	msgs := sm.readMessages()
+	if len(msgs) != 2 {
+		t.Fatalf("len(msgs) = %d, want 2", len(msgs))
+	}
+	for _, m := range msgs {
+		if m.MsgType != pb.MessageType_MsgAppend || m.Index != 2 || len(m.Entries) != 0 {
+			t.Errorf("msg = %+v, want an empty append after index 2", m)
+		}
+	}
+
+	// 2 matches, the entries follow
+	sm.Step(pb.Message{From: 2, To: 1, Term: 2, MsgType: pb.MessageType_MsgAppendResponse, Index: 2})
+	msgs = sm.readMessages()
+	if len(msgs) != 1 || msgs[0].To != 2 || msgs[0].Index != 2 || len(msgs[0].Entries) != 1 || msgs[0].Entries[0].Index != 3 {
+		t.Fatalf("msgs = %+v, want an append of entry 3 to 2", msgs)
+	}
+
+	// 3 is behind, the leader keeps probing
+	sm.Step(pb.Message{From: 3, To: 1, Term: 2, MsgType: pb.MessageType_MsgAppendResponse, Reject: true})
+	msgs = sm.readMessages()
+	if len(msgs) != 1 || msgs[0].To != 3 || msgs[0].Index != 1 || len(msgs[0].Entries) != 0 {
+		t.Fatalf("msgs = %+v, want an empty append after index 1 to 3", msgs)
+	}
+	if !sm.Prs[3].Probe || sm.Prs[2].Probe {
+		t.Errorf("probe 2, 3 = %v, %v, want false, true", sm.Prs[2].Probe, sm.Prs[3].Probe)
+	}
+}
+
+// TestSendAppendPaused2AB tests that sendAppend sends nothing to a peer whose
+// probe is unanswered, keeps sending to a replicating one, and that any
+// response from the peer resumes it. A pending snapshot isn't resumed by a
+// heartbeat response, only by its ack.
+func TestSendAppendPaused2AB(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Append([]pb.Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2}})
+	storage.SetHardState(pb.HardState{Term: 1})
+	cfg := newTestConfig(1, []uint64{1, 2, 3}, 10, 1, storage)
+	cfg.ProbeAfterElection = true
+	sm := newRaft(cfg)
+	sm.becomeCandidate()
+	sm.becomeLeader()
+	sm.Prs[3].Probe = false
+	sm.readMessages()
+
+	for i, w := range []bool{true, false} {
+		if g := sm.sendAppend(2); g != w {
+			t.Errorf("#%d: sendAppend(2) = %v, want %v", i, g, w)
+		}
+		if g := sm.sendAppend(3); !g {
+			t.Errorf("#%d: sendAppend(3) = %v, want true", i, g)
+		}
+	}
+	if !sm.Prs[2].IsPaused() || sm.Prs[3].IsPaused() {
+		t.Errorf("paused 2, 3 = %v, %v, want true, false", sm.Prs[2].IsPaused(), sm.Prs[3].IsPaused())
+	}
+	if msgs := sm.readMessages(); len(msgs) != 3 {
+		t.Errorf("len(msgs) = %d, want 3", len(msgs))
+	}
+
+	// the probe was lost, the heartbeat response resumes it
+	sm.Step(pb.Message{From: 2, To: 1, Term: 2, MsgType: pb.MessageType_MsgHeartbeatResponse})
+	msgs := sm.readMessages()
+	if len(msgs) != 1 || msgs[0].To != 2 || msgs[0].MsgType != pb.MessageType_MsgAppend || len(msgs[0].Entries) != 0 {
+		t.Fatalf("msgs = %+v, want a probe to 2", msgs)
+	}
+	sm.Step(pb.Message{From: 2, To: 1, Term: 2, MsgType: pb.MessageType_MsgAppendResponse, Index: 2})
+	if sm.Prs[2].IsPaused() {
+		t.Errorf("2 paused after its probe was answered")
+	}
+	if g := sm.sendAppend(2); !g {
+		t.Errorf("sendAppend(2) = %v, want true", g)
+	}
+
+	// a snapshot holds the peer back across heartbeat responses until an
+	// append response comes back or its commit shows it has the snapshot
+	storage = NewMemoryStorage()
+	storage.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 5, Term: 1, ConfState: &pb.ConfState{Nodes: []uint64{1, 2, 3}}}})
+	storage.Append([]pb.Entry{{Term: 1, Index: 6}})
+	storage.SetHardState(pb.HardState{Term: 1, Commit: 6})
+	sm = newTestRaft(1, nil, 10, 1, storage)
+	sm.becomeCandidate()
+	sm.becomeLeader()
+	sm.readMessages()
+	sendSnap := func(to uint64) {
+		sm.Prs[to].Next = 5
+		sm.sendAppend(to)
+		if msgs := sm.readMessages(); len(msgs) != 1 || msgs[0].MsgType != pb.MessageType_MsgSnapshot {
+			t.Fatalf("msgs = %+v, want a snapshot to %d", msgs, to)
+		}
+	}
+	sendSnap(2)
+	sendSnap(3)
+	for i := 0; i < 2; i++ {
+		for _, id := range []uint64{2, 3} {
+			sm.Step(pb.Message{From: id, To: 1, Term: 2, MsgType: pb.MessageType_MsgHeartbeatResponse})
+		}
+		if msgs := sm.readMessages(); len(msgs) != 0 {
+			t.Fatalf("#%d: msgs = %+v, want none while the snapshots are pending", i, msgs)
+		}
+		if !sm.Prs[2].IsPaused() || !sm.Prs[3].IsPaused() {
+			t.Fatalf("#%d: 2, 3 not paused with a pending snapshot", i)
+		}
+	}
+	sm.Step(pb.Message{From: 2, To: 1, Term: 2, MsgType: pb.MessageType_MsgAppendResponse, Index: 5})
+	sm.Step(pb.Message{From: 3, To: 1, Term: 2, MsgType: pb.MessageType_MsgHeartbeatResponse, Commit: 5})
+	for _, id := range []uint64{2, 3} {
+		if pr := sm.Prs[id]; pr.IsPaused() || pr.Match != 5 {
+			t.Errorf("%d: paused, match = %v, %d, want false, 5", id, pr.IsPaused(), pr.Match)
+		}
+	}
+	msgs = sm.readMessages()
+	if len(msgs) != 2 || msgs[0].MsgType != pb.MessageType_MsgAppend || msgs[1].MsgType != pb.MessageType_MsgAppend {
+		t.Errorf("msgs = %+v, want the appends after the snapshot to 2 and 3", msgs)
+	}
+}
+
+// TestProposeMultipleConfChanges3A tests that a proposal carrying more than
+// one conf change is rejected with ErrMultipleConfChanges and appends
+// nothing, while a single one along with normal entries is accepted.
+func TestProposeMultipleConfChanges3A(t *testing.T) {
+	sm := newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())
+	sm.becomeCandidate()
+	sm.becomeLeader()
+	lastIndex := sm.RaftLog.LastIndex()
+
+	cc := func(id uint64) *pb.Entry {
+		data, err := (&pb.ConfChange{ChangeType: pb.ConfChangeType_AddNode, NodeId: id}).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &pb.Entry{EntryType: pb.EntryType_EntryConfChange, Data: data}
+	}
+	err := sm.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{cc(3), {Data: []byte("a")}, cc(4)}})
+	if err != ErrMultipleConfChanges {
+		t.Errorf("err = %v, want %v", err, ErrMultipleConfChanges)
+	}
+	if g := sm.RaftLog.LastIndex(); g != lastIndex || sm.PendingConfIndex != 0 {
+		t.Errorf("lastIndex, pendingConfIndex = %d, %d, want %d, 0", g, sm.PendingConfIndex, lastIndex)
+	}
+
+	if err := sm.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{cc(3), {Data: []byte("a")}}}); err != nil {
+		t.Errorf("single conf change: err = %v, want nil", err)
+	}
+	if g := sm.RaftLog.LastIndex(); g != lastIndex+2 {
+		t.Errorf("lastIndex = %d, want %d", g, lastIndex+2)
+	}
+}
+
+// TestPendingConfChange3A tests that a proposed conf change is reported as
+// pending until it is applied.
+func TestPendingConfChange3A(t *testing.T) {
+	sm := newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())
+	sm.becomeCandidate()
+	sm.becomeLeader()
+	if _, ok := sm.pendingConfChange(); ok {
+		t.Fatalf("pending conf change before any was proposed")
+	}
+
+	cc, err := (&pb.ConfChange{ChangeType: pb.ConfChangeType_AddNode, NodeId: 3}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{
+		{EntryType: pb.EntryType_EntryConfChange, Data: cc},
+	}})
+	if index, ok := sm.pendingConfChange(); !ok || index != 2 {
+		t.Errorf("pendingConfChange = %d, %v, want 2, true", index, ok)
+	}
+
+	sm.Step(pb.Message{From: 2, To: 1, Term: 1, MsgType: pb.MessageType_MsgAppendResponse, Index: 2})
+	if sm.RaftLog.committed != 2 {
+		t.Fatalf("committed = %d, want 2", sm.RaftLog.committed)
+	}
+	if index, ok := sm.pendingConfChange(); !ok || index != 2 {
+		t.Errorf("committed: pendingConfChange = %d, %v, want 2, true", index, ok)
+	}
+	sm.RaftLog.applied = 2
+	if index, ok := sm.pendingConfChange(); ok {
+		t.Errorf("applied: pendingConfChange = %d, %v, want not present", index, ok)
+	}
+}
+
+// TestLeaderAppendEntryTypes3A tests that the leader keeps the type of the
+// entries it appends, the no-op is a normal entry, and a conf change entry
+// moves PendingConfIndex.
+func TestLeaderAppendEntryTypes3A(t *testing.T) {
+	sm := newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())
+	sm.becomeCandidate()
+	sm.becomeLeader()
+	if sm.PendingConfIndex != 0 {
+		t.Errorf("pendingConfIndex = %d, want 0", sm.PendingConfIndex)
+	}
+
+	cc, err := (&pb.ConfChange{ChangeType: pb.ConfChangeType_AddNode, NodeId: 3}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{
+		{Data: []byte("somedata")},
+		{EntryType: pb.EntryType_EntryConfChange, Data: cc},
+		{Data: []byte("somedata")},
+	}})
+
+	wtypes := []pb.EntryType{pb.EntryType_EntryNormal, pb.EntryType_EntryNormal, pb.EntryType_EntryConfChange, pb.EntryType_EntryNormal}
+	ents := sm.RaftLog.allEntries()
+	if len(ents) != len(wtypes) {
+		t.Fatalf("len(ents) = %d, want %d", len(ents), len(wtypes))
+	}
+	for i, e := range ents {
+		if e.EntryType != wtypes[i] || e.Term != 1 || e.Index != uint64(i+1) {
+			t.Errorf("#%d: entry = %+v, want type %v at term 1 index %d", i, e, wtypes[i], i+1)
+		}
+	}
+	if ents[0].Data != nil {
+		t.Errorf("noop data = %v, want nil", ents[0].Data)
+	}
+	if sm.PendingConfIndex != 3 {
+		t.Errorf("pendingConfIndex = %d, want 3", sm.PendingConfIndex)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("unknown entry type: want panic")
+		}
+	}()
+	sm.leaderAppendEntries(&pb.Entry{EntryType: pb.EntryType(100)})
+}
+
+// TestLeaderAppendEntriesNotLeader2AB tests that appending on a node that
+// isn't leader, e.g. right after stepping down, fails without touching the log.
+func TestLeaderAppendEntriesNotLeader2AB(t *testing.T) {
+	sm := newTestRaft(1, []uint64{1, 2}, 10, 1, NewMemoryStorage())
+	sm.becomeCandidate()
+	sm.becomeLeader()
+	sm.becomeFollower(2, 2)
+
+	li, err := sm.leaderAppendEntries(&pb.Entry{Data: []byte("somedata")})
+	if err != ErrNotLeader || li != 0 {
+		t.Errorf("leaderAppendEntries = %d, %v, want 0, %v", li, err, ErrNotLeader)
+	}
+	if g := sm.RaftLog.LastIndex(); g != 1 {
+		t.Errorf("lastIndex = %d, want 1", g)
+	}
+}
+
+// TestSkipLeaderNoop2AB tests that with SkipLeaderNoop a new leader appends
+// no entry, and still doesn't commit entries of older terms until an entry
+// of its own term is replicated.
+func TestSkipLeaderNoop2AB(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Append([]pb.Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2}})
+	storage.SetHardState(pb.HardState{Term: 1})
+	c := newTestConfig(1, []uint64{1, 2, 3}, 10, 1, storage)
+	c.SkipLeaderNoop = true
+	r := newRaft(c)
+	r.becomeCandidate()
+	r.becomeLeader()
+	if li := r.RaftLog.LastIndex(); li != 2 {
+		t.Fatalf("lastIndex = %d, want 2", li)
+	}
+
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: 2})
+	if r.RaftLog.committed != 0 {
+		t.Errorf("committed = %d, want 0", r.RaftLog.committed)
+	}
+
+	r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("marker")}}})
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: 3})
+	if r.RaftLog.committed != 3 {
+		t.Errorf("committed = %d, want 3", r.RaftLog.committed)
+	}
+}
+
+// TestRemoveLeaderSelf3A tests that a leader removing itself steps down
+// instead of panicking on its missing Progress, and doesn't campaign again.
+func TestRemoveLeaderSelf3A(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+
+	r.removeNode(1)
+	if r.State != StateFollower {
+		t.Fatalf("state = %s, want %s", r.State, StateFollower)
+	}
+	if w, g := []uint64{2, 3}, nodes(r); !reflect.DeepEqual(g, w) {
+		t.Errorf("nodes = %v, want %v", g, w)
+	}
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: 1})
+
+	r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	if r.State != StateFollower {
+		t.Errorf("state = %s, want %s after campaign", r.State, StateFollower)
+	}
+}
+
+// TestSingleNodeCommitInStep2AB tests that a one-node leader commits its
+// entries within the step that appends them, without any message.
+func TestSingleNodeCommitInStep2AB(t *testing.T) {
+	r := newTestRaft(1, []uint64{1}, 10, 1, NewMemoryStorage())
+	r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	if r.State != StateLeader {
+		t.Fatalf("state = %s, want %s", r.State, StateLeader)
+	}
+	if r.RaftLog.committed != 1 {
+		t.Errorf("committed = %d, want 1", r.RaftLog.committed)
+	}
+
+	r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}})
+	if r.RaftLog.committed != 2 {
+		t.Errorf("committed = %d, want 2", r.RaftLog.committed)
+	}
+	if msgs := r.readMessages(); len(msgs) != 0 {
+		t.Errorf("msgs = %+v, want none", msgs)
+	}
+}
+
+// TestCommitResentOnHeartbeat2AB tests that a follower which has the entries
+// but lost the append carrying their commit gets the commit again once its
+// heartbeat response shows it's behind.
+func TestCommitResentOnHeartbeat2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	lead, n3 := nt.peers[1].(*Raft), nt.peers[3].(*Raft)
+
+	// 3 gets the entry, but not the commit of it
+	nt.msgHook = func(m pb.Message) bool {
+		return !(m.To == 3 && m.MsgType == pb.MessageType_MsgAppend && m.Commit == lead.RaftLog.LastIndex())
+	}
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("x")}}})
+	li := lead.RaftLog.LastIndex()
+	if lead.RaftLog.committed != li || n3.RaftLog.LastIndex() != li || n3.RaftLog.committed >= li {
+		t.Fatalf("leader committed %d, 3 has %d committed %d, want 3 to have %d but not its commit",
+			lead.RaftLog.committed, n3.RaftLog.LastIndex(), n3.RaftLog.committed, li)
+	}
+
+	nt.msgHook = nil
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+	if g := n3.RaftLog.committed; g != li {
+		t.Errorf("3 committed = %d, want %d", g, li)
+	}
+	if g := lead.Prs[3].Commit; g != li {
+		t.Errorf("leader's view of 3's commit = %d, want %d", g, li)
+	}
+}
+
+// TestCommitFromHeartbeat2AB tests that an idle follower which has the
+// entries learns their commit from heartbeats alone, and that the leader
+// never tells a follower to commit past its Match.
+func TestCommitFromHeartbeat2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	lead, n3 := nt.peers[1].(*Raft), nt.peers[3].(*Raft)
+
+	nt.msgHook = func(m pb.Message) bool {
+		return !(m.To == 3 && m.MsgType == pb.MessageType_MsgAppend && m.Commit == lead.RaftLog.LastIndex())
+	}
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("x")}}})
+	li := lead.RaftLog.LastIndex()
+	if lead.RaftLog.committed != li || n3.RaftLog.committed >= li {
+		t.Fatalf("leader committed %d, 3 committed %d, want %d and less", lead.RaftLog.committed, n3.RaftLog.committed, li)
+	}
+
+	nt.msgHook = nil
+	nt.ignore(pb.MessageType_MsgAppend)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+	if g := n3.RaftLog.committed; g != li {
+		t.Errorf("3 committed = %d, want %d", g, li)
+	}
+
+	lead.Prs[2].Match = 1
+	if m := lead.NewHeartbeatMsg(2); m.Commit != 1 {
+		t.Errorf("heartbeat commit = %d, want capped to match 1", m.Commit)
+	}
+}
+
+// TestHeartbeatNoCommitBeforeAck2AB tests that a new leader's heartbeat
+// doesn't commit a follower's tail that its appends haven't checked yet,
+// even below the leader's snapshot: the tail may be from an older term.
+func TestHeartbeatNoCommitBeforeAck2AB(t *testing.T) {
+	ls := NewMemoryStorage()
+	ls.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 10, Term: 2, ConfState: &pb.ConfState{Nodes: []uint64{1, 2}}}})
+	lead := newTestRaft(1, []uint64{1, 2}, 10, 1, ls)
+	lead.becomeCandidate()
+	lead.becomeLeader()
+	// the appends are lost
+	lead.readMessages()
+
+	fs := NewMemoryStorage()
+	fs.Append([]pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}, {Index: 4, Term: 1}, {Index: 5, Term: 1}})
+	fs.SetHardState(pb.HardState{Term: 1, Commit: 3})
+	follower := newTestRaft(2, []uint64{1, 2}, 10, 1, fs)
+
+	lead.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+	for _, m := range lead.readMessages() {
+		follower.Step(m)
+	}
+	if g := follower.RaftLog.committed; g != 3 {
+		t.Errorf("follower committed = %d, want 3", g)
+	}
+}
+
+// TestNoopResentOnHeartbeat2AB tests that a no-op whose first broadcast was
+// lost is resent on heartbeat responses and commits without any proposal.
+func TestNoopResentOnHeartbeat2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.ignore(pb.MessageType_MsgAppend)
+	if !nt.elect(1) {
+		t.Fatal("elect(1) = false, want true")
+	}
+	sm := nt.peers[1].(*Raft)
+	if sm.RaftLog.committed != 0 {
+		t.Fatalf("committed = %d with all appends lost, want 0", sm.RaftLog.committed)
+	}
+
+	nt.recover()
+	for i := 0; i < sm.heartbeatTimeout; i++ {
+		sm.tick()
+	}
+	nt.send(sm.readMessages()...)
+
+	for id, p := range nt.peers {
+		if c := p.(*Raft).RaftLog.committed; c != 1 {
+			t.Errorf("peer %d: committed = %d, want 1", id, c)
+		}
+	}
+}
+
+// TestHeartbeatResponseAppends2AB tests which heartbeat responses make the
+// leader send an append: a follower missing entries gets them, one that has
+// them all but not their commit gets the commit, an up to date one nothing.
+func TestHeartbeatResponseAppends2AB(t *testing.T) {
+	tests := []struct {
+		match, commit uint64
+		wappend       bool
+	}{
+		{1, 1, true},
+		{2, 1, true},
+		{2, 2, false},
+	}
+	for i, tt := range tests {
+		sm := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+		sm.becomeCandidate()
+		sm.becomeLeader()
+		sm.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("x")}}})
+		sm.Step(pb.Message{From: 3, To: 1, Term: 1, MsgType: pb.MessageType_MsgAppendResponse, Index: 2})
+		if sm.RaftLog.committed != 2 {
+			t.Fatalf("#%d: committed = %d, want 2", i, sm.RaftLog.committed)
+		}
+		sm.Prs[2].Match, sm.Prs[2].Next = tt.match, tt.match+1
+		sm.readMessages()
+
+		sm.Step(pb.Message{From: 2, To: 1, Term: 1, MsgType: pb.MessageType_MsgHeartbeatResponse, Commit: tt.commit})
+		msgs := sm.readMessages()
+		if g := len(msgs) == 1 && msgs[0].MsgType == pb.MessageType_MsgAppend; g != tt.wappend {
+			t.Errorf("#%d: msgs = %+v, want append %v", i, msgs, tt.wappend)
+		}
+		if tt.wappend && (msgs[0].Index != tt.match || msgs[0].Commit != 2) {
+			t.Errorf("#%d: append after %d commit %d, want after %d commit 2", i, msgs[0].Index, msgs[0].Commit, tt.match)
+		}
+	}
+}
+
+// TestBatchProposals2AB tests that with BatchProposals the proposals stepped
+// between two reads of the messages go out in a single append per follower.
+func TestBatchProposals2AB(t *testing.T) {
+	cfg := newTestConfig(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	cfg.BatchProposals = true
+	r := newRaft(cfg)
+	r.becomeCandidate()
+	r.becomeLeader()
+	for _, id := range []uint64{2, 3} {
+		r.Step(pb.Message{From: id, To: 1, Term: 1, MsgType: pb.MessageType_MsgAppendResponse, Index: 1})
+	}
+	r.readMessages()
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		if err := r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(r.msgs) != 0 {
+		t.Fatalf("%d msgs queued before the read, want 0", len(r.msgs))
+	}
+
+	msgs := r.readMessages()
+	if len(msgs) != 2 {
+		t.Fatalf("len(msgs) = %d, want 2", len(msgs))
+	}
+	for _, m := range msgs {
+		if m.MsgType != pb.MessageType_MsgAppend || m.Index != 1 || len(m.Entries) != n {
+			t.Errorf("msg = %+v, want an append of %d entries after index 1", m, n)
+		}
+	}
+	if msgs = r.readMessages(); len(msgs) != 0 {
+		t.Errorf("msgs = %+v, want none", msgs)
+	}
+}
+
+// TestMaxMsgsPerFlush2AB tests that with MaxMsgsPerFlush a broadcast is
+// spread over several reads of the messages, and every follower gets its
+// message once.
+func TestMaxMsgsPerFlush2AB(t *testing.T) {
+	cfg := newTestConfig(1, []uint64{1, 2, 3, 4, 5, 6}, 10, 1, NewMemoryStorage())
+	cfg.MaxMsgsPerFlush = 2
+	r := newRaft(cfg)
+	r.becomeCandidate()
+	r.becomeLeader()
+
+	for _, tt := range []struct {
+		bcast func()
+		mt    pb.MessageType
+	}{
+		{func() { r.bcastAppend(false) }, pb.MessageType_MsgAppend},
+		{r.bckstHeart, pb.MessageType_MsgHeartbeat},
+	} {
+		tt.bcast()
+		var sizes []int
+		got := map[uint64]int{}
+		for len(r.owed) != 0 {
+			msgs := r.readMessages()
+			sizes = append(sizes, len(msgs))
+			for _, m := range msgs {
+				if m.MsgType != tt.mt {
+					t.Errorf("msg type = %v, want %v", m.MsgType, tt.mt)
+				}
+				got[m.To]++
+			}
+		}
+		if !reflect.DeepEqual(sizes, []int{2, 2, 1}) {
+			t.Errorf("%v: flush sizes = %v, want [2 2 1]", tt.mt, sizes)
+		}
+		if w := map[uint64]int{2: 1, 3: 1, 4: 1, 5: 1, 6: 1}; !reflect.DeepEqual(got, w) {
+			t.Errorf("%v: sent to %v, want %v", tt.mt, got, w)
+		}
+	}
+}
+
+// TestProposeBeforeNoopCommit2AB tests that a proposal right after election
+// is appended after the leader's no-op and doesn't commit before it, and that
+// a node no longer leading drops proposals.
+func TestProposeBeforeNoopCommit2AB(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r.becomeCandidate()
+	r.becomeLeader()
+	if err := r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}}); err != nil {
+		t.Fatalf("err = %v, want nil", err)
+	}
+	if r.noopIndex != 1 || r.RaftLog.LastIndex() != 2 {
+		t.Fatalf("noop, lastIndex = %d, %d, want 1, 2", r.noopIndex, r.RaftLog.LastIndex())
+	}
+	if r.RaftLog.committed != 0 {
+		t.Errorf("committed = %d, want 0", r.RaftLog.committed)
+	}
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: 2})
+	if r.RaftLog.committed != 2 {
+		t.Errorf("committed = %d, want 2", r.RaftLog.committed)
 	}
 
-	// remove all nodes from cluster
-	r.removeNode(1)
-	w = []uint64{}
-	if g := nodes(r); !reflect.DeepEqual(g, w) {
-		t.Errorf("nodes = %v, want %v", g, w)
+	r.becomeFollower(r.Term+1, None)
+	if err := r.handleProse(pb.Message{Entries: []*pb.Entry{{Data: []byte("late")}}}); err != ErrProposalDropped {
+		t.Errorf("err = %v, want %v", err, ErrProposalDropped)
+	}
+	if r.RaftLog.LastIndex() != 2 {
+		t.Errorf("lastIndex = %d, want 2", r.RaftLog.LastIndex())
 	}
 }
 
@@ -1310,6 +3512,26 @@ func TestLeaderTransferToUpToDateNode3A(t *testing.T) {
 	checkLeaderTransferState(t, lead, StateLeader, 1)
 }
 
+// TestLeaderTransferCheckQuorum3A verifies that with CheckQuorum the leader
+// grants its transferee's vote request despite its lease, so the transfer
+// succeeds, while a vote request from another node is still ignored.
+func TestLeaderTransferCheckQuorum3A(t *testing.T) {
+	nt := newNetworkWithConfig(func(c *Config) { c.CheckQuorum = true }, nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	lead := nt.peers[1].(*Raft)
+
+	nt.send(pb.Message{From: 2, To: 1, MsgType: pb.MessageType_MsgTransferLeader})
+
+	checkLeaderTransferState(t, lead, StateFollower, 2)
+	if r2 := nt.peers[2].(*Raft); r2.State != StateLeader || r2.Term != 2 {
+		t.Fatalf("transferee state/term = %s/%d, want %s/2", r2.State, r2.Term, StateLeader)
+	}
+
+	// 3 campaigns without a transfer, the new leader's lease holds
+	nt.send(pb.Message{From: 3, To: 3, MsgType: pb.MessageType_MsgHup})
+	checkLeaderTransferState(t, nt.peers[2].(*Raft), StateLeader, 2)
+}
+
 // TestLeaderTransferToUpToDateNodeFromFollower verifies transferring should succeed
 // if the transferee has the most up-to-date log entries when transfer starts.
 // Not like TestLeaderTransferToUpToDateNode, where the leader transfer message
@@ -1464,12 +3686,86 @@ func TestLeaderTransferSecondTransferToAnotherNode3A(t *testing.T) {
 	checkLeaderTransferState(t, lead, StateFollower, 2)
 }
 
+// TestFollowerForwardTransferLeader3A tests that a follower forwards a leader
+// transfer request to its leader, and drops it if it doesn't know one.
+func TestFollowerForwardTransferLeader3A(t *testing.T) {
+	r := newTestRaft(2, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r.becomeFollower(1, 1)
+	r.Step(pb.Message{From: 3, To: 2, MsgType: pb.MessageType_MsgTransferLeader})
+	wmsgs := []pb.Message{{From: 3, To: 1, Term: 1, MsgType: pb.MessageType_MsgTransferLeader}}
+	if msgs := r.readMessages(); !reflect.DeepEqual(msgs, wmsgs) {
+		t.Errorf("msgs = %+v, want %+v", msgs, wmsgs)
+	}
+
+	r.becomeFollower(2, None)
+	r.Step(pb.Message{From: 3, To: 2, MsgType: pb.MessageType_MsgTransferLeader})
+	if msgs := r.readMessages(); len(msgs) != 0 {
+		t.Errorf("msgs = %+v, want none", msgs)
+	}
+}
+
+// TestHupDuringLeaderTransfer3A tests that MsgHup is ignored while a leader
+// transfer is in progress, and MsgTimeoutNow makes the transferee campaign
+// right away, before its election timeout.
+func TestHupDuringLeaderTransfer3A(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	lead := nt.peers[1].(*Raft)
+
+	nt.isolate(3)
+	nt.send(pb.Message{From: 3, To: 1, MsgType: pb.MessageType_MsgTransferLeader})
+	if lead.leadTransferee != 3 {
+		t.Fatalf("leadTransferee = %d, want 3", lead.leadTransferee)
+	}
+	term := lead.Term
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	if lead.State != StateLeader || lead.Term != term || lead.leadTransferee != 3 {
+		t.Fatalf("state, term, transferee = %s, %d, %d, want %s, %d, 3", lead.State, lead.Term, lead.leadTransferee, StateLeader, term)
+	}
+
+	r3 := nt.peers[3].(*Raft)
+	if r3.electionElapsed >= r3.electionTimeout {
+		t.Fatalf("electionElapsed = %d, want below timeout", r3.electionElapsed)
+	}
+	nt.recover()
+	nt.send(pb.Message{From: 1, To: 3, Term: lead.Term, MsgType: pb.MessageType_MsgTimeoutNow})
+	if r3.State != StateLeader || r3.Term != term+1 {
+		t.Errorf("state, term = %s, %d, want %s, %d", r3.State, r3.Term, StateLeader, term+1)
+	}
+}
+
 func checkLeaderTransferState(t *testing.T, r *Raft, state StateType, lead uint64) {
 	if r.State != state || r.Lead != lead {
 		t.Fatalf("after transferring, node has state %v lead %v, want state %v lead %v", r.State, r.Lead, state, lead)
 	}
 }
 
+// TestPrematureTimeoutNow3A verifies that a MsgTimeoutNow arriving before the
+// transferee caught up with the leader's log is ignored, and that the leader
+// still hands over once it caught up.
+func TestPrematureTimeoutNow3A(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	nt.isolate(3)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{}}})
+	nt.recover()
+
+	lead := nt.peers[1].(*Raft)
+	// a MsgTimeoutNow sent prematurely, the entry proposed isn't on 3 yet
+	nt.ignore(pb.MessageType_MsgAppend)
+	m := lead.NewTimeoutNowMsg(3)
+	m.From, m.Term = 1, lead.Term
+	nt.send(m)
+	if n3 := nt.peers[3].(*Raft); n3.State != StateFollower || n3.Term != lead.Term {
+		t.Fatalf("3 state, term = %v, %d, want %v, %d", n3.State, n3.Term, StateFollower, lead.Term)
+	}
+	checkLeaderTransferState(t, lead, StateLeader, 1)
+
+	nt.recover()
+	nt.send(pb.Message{From: 3, To: 1, MsgType: pb.MessageType_MsgTransferLeader})
+	checkLeaderTransferState(t, lead, StateFollower, 3)
+}
+
 // TestTransferNonMember verifies that when a MessageType_MsgTimeoutNow arrives at
 // a node that has been removed from the group, nothing happens.
 // (previously, if the node also got votes, it would panic as it
@@ -1558,6 +3854,520 @@ func TestSplitVote2AA(t *testing.T) {
 	}
 }
 
+// TestQuorumFuncUnanimous2AB tests that a QuorumFunc requiring every voter
+// is used both to win the election and to commit.
+func TestQuorumFuncUnanimous2AB(t *testing.T) {
+	unanimous := func(voters []uint64, granted map[uint64]bool) VoteResult {
+		for _, id := range voters {
+			v, ok := granted[id]
+			if !ok {
+				return VotePending
+			}
+			if !v {
+				return VoteLost
+			}
+		}
+		return VoteWon
+	}
+	cfg := newTestConfig(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	cfg.QuorumFunc = unanimous
+	r := newRaft(cfg)
+
+	r.Step(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	r.Step(pb.Message{From: 2, To: 1, Term: 1, MsgType: pb.MessageType_MsgRequestVoteResponse})
+	if r.State != StateCandidate {
+		t.Fatalf("state = %v after 2 of 3 votes, want %v", r.State, StateCandidate)
+	}
+	r.Step(pb.Message{From: 3, To: 1, Term: 1, MsgType: pb.MessageType_MsgRequestVoteResponse})
+	if r.State != StateLeader {
+		t.Fatalf("state = %v after 3 of 3 votes, want %v", r.State, StateLeader)
+	}
+
+	r.Step(pb.Message{From: 2, To: 1, Term: 1, MsgType: pb.MessageType_MsgAppendResponse, Index: 1})
+	if r.RaftLog.committed != 0 {
+		t.Errorf("committed = %d with 2 of 3 acks, want 0", r.RaftLog.committed)
+	}
+	r.Step(pb.Message{From: 3, To: 1, Term: 1, MsgType: pb.MessageType_MsgAppendResponse, Index: 1})
+	if r.RaftLog.committed != 1 {
+		t.Errorf("committed = %d with 3 of 3 acks, want 1", r.RaftLog.committed)
+	}
+}
+
+// TestCommittedIndex2AB tests the quorum index for known Match distributions,
+// and that computing it leaves the commit index alone.
+func TestCommittedIndex2AB(t *testing.T) {
+	tests := []struct {
+		// matches of the followers, the leader (id 1) has the whole log
+		matches []uint64
+		w       uint64
+	}{
+		{[]uint64{0, 0}, 0},
+		{[]uint64{3, 0}, 3},
+		{[]uint64{2, 3}, 3},
+		{[]uint64{1, 2}, 2},
+		// 4 nodes, a quorum is 3
+		{[]uint64{0, 0, 0}, 0},
+		{[]uint64{3, 0, 0}, 0},
+		{[]uint64{3, 2, 0}, 2},
+		{[]uint64{5, 4, 3}, 4},
+		// 5 nodes
+		{[]uint64{5, 0, 0, 0}, 0},
+		{[]uint64{5, 4, 0, 0}, 4},
+		{[]uint64{1, 2, 3, 4}, 3},
+	}
+	for i, tt := range tests {
+		ids := []uint64{1}
+		for j := range tt.matches {
+			ids = append(ids, uint64(j+2))
+		}
+		storage := NewMemoryStorage()
+		for j := uint64(1); j <= 5; j++ {
+			storage.Append([]pb.Entry{{Index: j, Term: 1}})
+		}
+		r := newTestRaft(1, ids, 10, 1, storage)
+		for j, m := range tt.matches {
+			r.Prs[uint64(j+2)].Match = m
+		}
+		if g := r.committedIndex(); g != tt.w {
+			t.Errorf("#%d: committedIndex = %d, want %d", i, g, tt.w)
+		}
+		if r.RaftLog.committed != 0 {
+			t.Errorf("#%d: committed = %d, want 0", i, r.RaftLog.committed)
+		}
+	}
+}
+
+// TestVisitProgressOrder2AB tests that visitProgress iterates the peers in
+// descending Match order, breaking ties by id.
+func TestVisitProgressOrder2AB(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3, 4, 5}, 10, 1, NewMemoryStorage())
+	matches := map[uint64]uint64{1: 7, 2: 3, 3: 9, 4: 3, 5: 0}
+	for id, m := range matches {
+		r.Prs[id].Match = m
+	}
+
+	var ids []uint64
+	r.visitProgress(func(id uint64, pr *Progress) {
+		if pr.Match != matches[id] {
+			t.Errorf("peer %d: match = %d, want %d", id, pr.Match, matches[id])
+		}
+		ids = append(ids, id)
+	})
+	wids := []uint64{3, 1, 2, 4, 5}
+	if !reflect.DeepEqual(ids, wids) {
+		t.Errorf("ids = %v, want %v", ids, wids)
+	}
+}
+
+// TestReadIndexWaitNoopCommit2AB tests that a read issued right after the
+// election is held until the leader's no-op entry commits.
+func TestReadIndexWaitNoopCommit2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.ignore(pb.MessageType_MsgAppend)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+
+	lead := nt.peers[1].(*Raft)
+	if lead.State != StateLeader {
+		t.Fatalf("state = %s, want %s", lead.State, StateLeader)
+	}
+	ctx := []byte("ctx")
+	if err := lead.readIndex(ctx); err != nil {
+		t.Fatalf("read index error: %v", err)
+	}
+	if len(lead.readStates) != 0 {
+		t.Fatalf("readStates = %+v, want none before the no-op commits", lead.readStates)
+	}
+
+	// heartbeat responses make the leader resend the no-op.
+	nt.recover()
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+	if lead.RaftLog.committed != lead.noopIndex {
+		t.Fatalf("committed = %d, want %d", lead.RaftLog.committed, lead.noopIndex)
+	}
+	wrs := []ReadState{{Index: lead.noopIndex, RequestCtx: ctx}}
+	if !reflect.DeepEqual(lead.readStates, wrs) {
+		t.Errorf("readStates = %+v, want %+v", lead.readStates, wrs)
+	}
+	if len(lead.pendingReads) != 0 {
+		t.Errorf("pendingReads = %+v, want none", lead.pendingReads)
+	}
+}
+
+// TestReadIndexRounds2AB tests that two reads in flight are each confirmed by
+// the heartbeat acks of their own round, an ack of the first round doesn't
+// confirm the second one.
+func TestReadIndexRounds2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	lead := nt.peers[1].(*Raft)
+	if !lead.committedEntryInCurrentTerm() {
+		t.Fatalf("no-op %d not committed", lead.noopIndex)
+	}
+	lead.readMessages()
+
+	ack := func(from uint64, round uint64) {
+		lead.Step(pb.Message{From: from, To: 1, Term: lead.Term, MsgType: pb.MessageType_MsgHeartbeatResponse, Index: round, Commit: lead.RaftLog.committed})
+	}
+	rounds := make([]uint64, 2)
+	for i, ctx := range []string{"first", "second"} {
+		lead.readIndex([]byte(ctx))
+		msgs := lead.readMessages()
+		if len(msgs) != 2 {
+			t.Fatalf("%s: msgs = %+v, want heartbeats to 2 and 3", ctx, msgs)
+		}
+		for _, m := range msgs {
+			if m.MsgType != pb.MessageType_MsgHeartbeat || m.Index != msgs[0].Index {
+				t.Fatalf("%s: msg = %+v, want a heartbeat of one round", ctx, m)
+			}
+		}
+		rounds[i] = msgs[0].Index
+	}
+	if rounds[0] == rounds[1] {
+		t.Fatalf("rounds = %v, want different", rounds)
+	}
+	if len(lead.readStates) != 0 {
+		t.Fatalf("readStates = %+v, want none before any ack", lead.readStates)
+	}
+
+	commit := lead.RaftLog.committed
+	ack(2, rounds[0])
+	ack(3, rounds[0])
+	wrs := []ReadState{{Index: commit, RequestCtx: []byte("first")}}
+	if !reflect.DeepEqual(lead.readStates, wrs) {
+		t.Fatalf("readStates = %+v, want %+v", lead.readStates, wrs)
+	}
+	ack(3, rounds[1])
+	wrs = append(wrs, ReadState{Index: commit, RequestCtx: []byte("second")})
+	if !reflect.DeepEqual(lead.readStates, wrs) {
+		t.Errorf("readStates = %+v, want %+v", lead.readStates, wrs)
+	}
+
+	// a follower echoes the round of the heartbeat
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+	if g := lead.Prs[2].ReadRound; g != rounds[1] {
+		t.Errorf("2 acked round %d, want %d", g, rounds[1])
+	}
+}
+
+// TestStrictSafetyAbort2AB tests that with StrictSafety enabled an append that
+// would overwrite a committed entry triggers the abort hook and leaves the log
+// untouched.
+func TestStrictSafetyAbort2AB(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Append([]pb.Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}})
+	var reasons []string
+	cfg := newTestConfig(1, []uint64{1, 2}, 10, 1, storage)
+	cfg.StrictSafety = true
+	cfg.AbortHook = func(reason string) { reasons = append(reasons, reason) }
+	sm := newRaft(cfg)
+	sm.becomeFollower(2, 2)
+	sm.RaftLog.committed = 3
+
+	sm.Step(pb.Message{From: 2, To: 1, Term: 2, MsgType: pb.MessageType_MsgAppend, Index: 1, LogTerm: 1,
+		Entries: []*pb.Entry{{Index: 2, Term: 2}}, Commit: 3})
+	if len(reasons) != 1 {
+		t.Fatalf("abort hook called %d times, want 1", len(reasons))
+	}
+	if term := mustTerm(sm.RaftLog.Term(2)); term != 1 {
+		t.Errorf("term of entry 2 = %d, want 1", term)
+	}
+	if li := sm.RaftLog.LastIndex(); li != 3 {
+		t.Errorf("lastIndex = %d, want 3", li)
+	}
+
+	// a matching retransmit of committed entries is fine.
+	sm.Step(pb.Message{From: 2, To: 1, Term: 2, MsgType: pb.MessageType_MsgAppend, Index: 1, LogTerm: 1,
+		Entries: []*pb.Entry{{Index: 2, Term: 1}}, Commit: 3})
+	if len(reasons) != 1 {
+		t.Errorf("abort hook called %d times, want 1", len(reasons))
+	}
+}
+
+// TestConfigMismatch3A tests that peers and Prs drifting apart is reported:
+// after a conf change always, and after any Step with StrictSafety.
+func TestConfigMismatch3A(t *testing.T) {
+	tests := []struct {
+		drift   func(r *Raft)
+		wreason string
+	}{
+		{func(r *Raft) { r.peers = append(r.peers, 4) }, "4 in peers but not in Prs"},
+		{func(r *Raft) { r.Prs[4] = &Progress{} }, "4 in Prs but not in peers"},
+		{func(r *Raft) { r.peers = append(r.peers, 2); r.Prs[5] = &Progress{} }, "2 twice in peers"},
+	}
+	for i, tt := range tests {
+		var reasons []string
+		cfg := newTestConfig(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+		cfg.StrictSafety = true
+		cfg.AbortHook = func(reason string) { reasons = append(reasons, reason) }
+		r := newRaft(cfg)
+		if g := r.configMismatch(); g != "" {
+			t.Fatalf("#%d: mismatch = %q before the drift", i, g)
+		}
+		tt.drift(r)
+		r.Step(pb.Message{From: 2, To: 1, Term: 1, MsgType: pb.MessageType_MsgHeartbeat})
+		if len(reasons) != 1 || !strings.Contains(reasons[0], tt.wreason) {
+			t.Errorf("#%d: reasons = %q, want one with %q", i, reasons, tt.wreason)
+		}
+	}
+
+	// without StrictSafety a conf change still catches it, and panics
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r.peers = append(r.peers, 4)
+	r.Step(pb.Message{From: 2, To: 1, Term: 1, MsgType: pb.MessageType_MsgHeartbeat})
+	defer func() {
+		if recover() == nil {
+			t.Errorf("addNode with drifted config didn't panic")
+		}
+	}()
+	r.addNode(5)
+}
+
+// TestMatchMonotonic2AB checks that a reject received after an ack only
+// backs off Next, and never moves Match backward.
+func TestMatchMonotonic2AB(t *testing.T) {
+	storage := NewMemoryStorage()
+	storage.Append([]pb.Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2}, {Term: 1, Index: 3}})
+	r := newTestRaft(1, []uint64{1, 2}, 10, 1, storage)
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: 3})
+	pr := r.Prs[2]
+	if pr.Match != 3 || pr.Next != 4 {
+		t.Fatalf("match, next = %d, %d, want 3, 4", pr.Match, pr.Next)
+	}
+
+	// a stale reject must not push Next down to Match
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Reject: true})
+	if pr.Match != 3 || pr.Next != 4 {
+		t.Errorf("after reject match, next = %d, %d, want 3, 4", pr.Match, pr.Next)
+	}
+
+	// a delayed ack for an older index must not move Match back
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: 2})
+	if pr.Match != 3 {
+		t.Errorf("after stale ack match = %d, want 3", pr.Match)
+	}
+
+	r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppendResponse, Index: 4})
+	if pr.Match != 4 || pr.Next != 5 {
+		t.Errorf("after ack match, next = %d, %d, want 4, 5", pr.Match, pr.Next)
+	}
+}
+
+// TestProgressCommit2AB checks that the leader tracks the commit index each
+// follower reports in its append responses.
+func TestProgressCommit2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	nt.isolate(3)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("some data")}}})
+
+	lead := nt.peers[1].(*Raft)
+	if lead.RaftLog.committed != 2 {
+		t.Fatalf("committed = %d, want 2", lead.RaftLog.committed)
+	}
+	if c := lead.Prs[2].Commit; c != 2 {
+		t.Errorf("peer 2 commit = %d, want 2", c)
+	}
+	// peer 3 was isolated after it learned the no-op committed
+	if c := lead.Prs[3].Commit; c != 1 {
+		t.Errorf("peer 3 commit = %d, want 1", c)
+	}
+
+	nt.recover()
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+	if c := lead.Prs[3].Commit; c != 2 {
+		t.Errorf("peer 3 commit = %d, want 2", c)
+	}
+}
+
+// TestLeaderDetectsDuplicateLeader2AB tests that a leader receiving an append
+// from another leader of its own term flags it and leaves its log alone.
+func TestLeaderDetectsDuplicateLeader2AB(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		var reasons []string
+		cfg := newTestConfig(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+		cfg.StrictSafety = strict
+		cfg.AbortHook = func(reason string) { reasons = append(reasons, reason) }
+		r := newRaft(cfg)
+		r.becomeCandidate()
+		r.becomeLeader()
+
+		err := r.Step(pb.Message{From: 2, To: 1, Term: r.Term, MsgType: pb.MessageType_MsgAppend,
+			Index: 1, LogTerm: r.Term, Entries: []*pb.Entry{{Index: 2, Term: r.Term}}})
+		if err != ErrDuplicateLeader {
+			t.Errorf("strict %v: err = %v, want %v", strict, err, ErrDuplicateLeader)
+		}
+		if strict && len(reasons) != 1 || !strict && len(reasons) != 0 {
+			t.Errorf("strict %v: abort hook called %d times", strict, len(reasons))
+		}
+		if r.State != StateLeader || r.RaftLog.LastIndex() != 1 {
+			t.Errorf("strict %v: state, lastIndex = %s, %d, want %s, 1", strict, r.State, r.RaftLog.LastIndex(), StateLeader)
+		}
+	}
+}
+
+// TestFollowerDetectsDuplicateLeader2AB tests that a follower receiving an
+// append from a second leader of its term flags it and keeps its leader.
+func TestFollowerDetectsDuplicateLeader2AB(t *testing.T) {
+	var reasons []string
+	cfg := newTestConfig(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	cfg.StrictSafety = true
+	cfg.AbortHook = func(reason string) { reasons = append(reasons, reason) }
+	r := newRaft(cfg)
+	r.becomeFollower(2, 2)
+
+	err := r.Step(pb.Message{From: 3, To: 1, Term: 2, MsgType: pb.MessageType_MsgAppend,
+		Entries: []*pb.Entry{{Index: 1, Term: 2}}})
+	if err != ErrDuplicateLeader {
+		t.Errorf("err = %v, want %v", err, ErrDuplicateLeader)
+	}
+	if len(reasons) != 1 {
+		t.Errorf("abort hook called %d times, want 1", len(reasons))
+	}
+	if r.Lead != 2 || r.RaftLog.LastIndex() != 0 {
+		t.Errorf("lead, lastIndex = %d, %d, want 2, 0", r.Lead, r.RaftLog.LastIndex())
+	}
+	if msgs := r.readMessages(); len(msgs) != 0 {
+		t.Errorf("msgs = %+v, want none", msgs)
+	}
+}
+
+// TestRetransmittedVoteRegranted2AA tests that a candidate whose vote
+// response was lost over a lossy link wins with the identical retransmitted
+// request.
+func TestRetransmittedVoteRegranted2AA(t *testing.T) {
+	// 3's first grant to 1 is lost, the retransmit wins the election
+	nt := newNetwork(nil, nil, nil)
+	nt.isolate(2)
+	dropped := false
+	nt.msgHook = func(m pb.Message) bool {
+		if m.MsgType == pb.MessageType_MsgRequestVoteResponse && m.From == 3 && !dropped {
+			dropped = true
+			return false
+		}
+		return true
+	}
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	n1 := nt.peers[1].(*Raft)
+	if !dropped || n1.State != StateCandidate {
+		t.Fatalf("dropped, state = %v, %v, want true, %v", dropped, n1.State, StateCandidate)
+	}
+	last := n1.RaftLog.LastLog()
+	nt.send(pb.Message{From: 1, To: 3, Term: n1.Term, LogTerm: last.Term, Index: last.Index, MsgType: pb.MessageType_MsgRequestVote})
+	if n1.State != StateLeader {
+		t.Errorf("state after retransmit = %v, want %v", n1.State, StateLeader)
+	}
+}
+
+// TestRejectVoteAlreadyVoted2AA tests that a node which voted in a term
+// rejects any other candidate of the same term, but grants its vote again
+// to the same candidate.
+func TestRejectVoteAlreadyVoted2AA(t *testing.T) {
+	r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	r.Step(pb.Message{From: 2, To: 1, Term: 2, MsgType: pb.MessageType_MsgRequestVote})
+	if r.Vote != 2 {
+		t.Fatalf("vote = %d, want 2", r.Vote)
+	}
+	r.readMessages()
+
+	tests := []struct {
+		from    uint64
+		wreject bool
+	}{
+		{3, true},
+		{2, false},
+	}
+	for i, tt := range tests {
+		r.Step(pb.Message{From: tt.from, To: 1, Term: 2, MsgType: pb.MessageType_MsgRequestVote})
+		msgs := r.readMessages()
+		if len(msgs) != 1 || msgs[0].MsgType != pb.MessageType_MsgRequestVoteResponse || msgs[0].To != tt.from {
+			t.Fatalf("#%d: msgs = %+v, want a vote response to %d", i, msgs, tt.from)
+		}
+		if msgs[0].Reject != tt.wreject || msgs[0].Term != 2 {
+			t.Errorf("#%d: reject, term = %v, %d, want %v, 2", i, msgs[0].Reject, msgs[0].Term, tt.wreject)
+		}
+		if r.Vote != 2 {
+			t.Errorf("#%d: vote = %d, want 2", i, r.Vote)
+		}
+	}
+}
+
+// TestPauseReplication2AB tests that a paused follower receives no messages
+// until it is resumed, and then catches up with the leader.
+func TestPauseReplication2AB(t *testing.T) {
+	nt := newNetwork(nil, nil, nil)
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgHup})
+	lead := nt.peers[1].(*Raft)
+	follower := nt.peers[3].(*Raft)
+
+	var received int
+	nt.msgHook = func(m pb.Message) bool {
+		if m.To == 3 {
+			received++
+		}
+		return true
+	}
+	lead.pauseReplication(3)
+	for i := 0; i < 3; i++ {
+		nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgPropose, Entries: []*pb.Entry{{Data: []byte("somedata")}}})
+	}
+	nt.send(pb.Message{From: 1, To: 1, MsgType: pb.MessageType_MsgBeat})
+	if received != 0 {
+		t.Fatalf("paused follower received %d messages, want 0", received)
+	}
+	if lead.RaftLog.committed != 4 {
+		t.Fatalf("leader committed = %d, want 4", lead.RaftLog.committed)
+	}
+	if follower.RaftLog.LastIndex() != 1 {
+		t.Fatalf("follower lastIndex = %d, want 1", follower.RaftLog.LastIndex())
+	}
+
+	lead.resumeReplication(3)
+	nt.send(lead.readMessages()...)
+	if follower.RaftLog.LastIndex() != lead.RaftLog.LastIndex() {
+		t.Errorf("follower lastIndex = %d, want %d", follower.RaftLog.LastIndex(), lead.RaftLog.LastIndex())
+	}
+	if lead.Prs[3].Match != lead.RaftLog.LastIndex() {
+		t.Errorf("match = %d, want %d", lead.Prs[3].Match, lead.RaftLog.LastIndex())
+	}
+}
+
+// TestStrayResponseIgnored2AA tests that append and heartbeat responses
+// delivered to a follower or a candidate are a clean no-op.
+func TestStrayResponseIgnored2AA(t *testing.T) {
+	for _, state := range []StateType{StateFollower, StateCandidate} {
+		for _, mt := range []pb.MessageType{pb.MessageType_MsgAppendResponse, pb.MessageType_MsgHeartbeatResponse} {
+			r := newTestRaft(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+			if state == StateFollower {
+				r.becomeFollower(2, 2)
+			} else {
+				r.becomeFollower(1, None)
+				r.becomeCandidate()
+			}
+			r.electionElapsed = 3
+			r.readMessages()
+			term, lead, vote := r.Term, r.Lead, r.Vote
+
+			if err := r.Step(pb.Message{From: 3, To: 1, Term: r.Term, MsgType: mt, Index: 5}); err != nil {
+				t.Fatalf("%s %s: unexpected error %v", state, mt, err)
+			}
+			if r.State != state || r.Term != term || r.Lead != lead || r.Vote != vote {
+				t.Errorf("%s %s: state/term/lead/vote = %s/%d/%d/%d, want %s/%d/%d/%d",
+					state, mt, r.State, r.Term, r.Lead, r.Vote, state, term, lead, vote)
+			}
+			if r.electionElapsed != 3 {
+				t.Errorf("%s %s: electionElapsed = %d, want 3", state, mt, r.electionElapsed)
+			}
+			if msgs := r.readMessages(); len(msgs) != 0 {
+				t.Errorf("%s %s: msgs = %+v, want none", state, mt, msgs)
+			}
+		}
+	}
+}
+
 func entsWithConfig(configFunc func(*Config), id uint64, terms ...uint64) *Raft {
 	storage := NewMemoryStorage()
 	for i, term := range terms {
@@ -1652,6 +4462,26 @@ func (nw *network) send(msgs ...pb.Message) {
 	}
 }
 
+// elect campaigns id until it becomes leader or follows another leader, and
+// reports whether it won. A split vote is retried, a candidate that can't
+// reach a quorum gives up after a few campaigns.
+func (nw *network) elect(id uint64) bool {
+	sm, ok := nw.peers[id].(*Raft)
+	if !ok {
+		panic(fmt.Sprintf("peer %d is not a *Raft", id))
+	}
+	for i := 0; i < 10; i++ {
+		nw.send(pb.Message{From: id, To: id, MsgType: pb.MessageType_MsgHup})
+		switch {
+		case sm.State == StateLeader:
+			return true
+		case sm.State == StateFollower && sm.Lead != None:
+			return false
+		}
+	}
+	return false
+}
+
 func (nw *network) drop(from, to uint64, perc float64) {
 	nw.dropm[connem{from, to}] = perc
 }
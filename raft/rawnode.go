@@ -46,6 +46,9 @@ type Ready struct {
 	// The current state of a Node to be saved to stable storage BEFORE
 	// Messages are sent.
 	// HardState will be equal to empty state if there is no update.
+	// A vote granted in Messages is recorded here, or in a HardState of an
+	// earlier Ready, so a node that crashes after sending it can't vote
+	// again in the same term.
 	pb.HardState
 
 	// Entries specifies entries to be saved to stable storage BEFORE
@@ -53,18 +56,45 @@ type Ready struct {
 	Entries []pb.Entry
 
 	// Snapshot specifies the snapshot to be saved to stable storage.
+	// Passing this Ready to Advance confirms the snapshot is persisted and
+	// applied, until then it's returned again in every Ready, and the log
+	// and the ack to the leader stay where they were before it.
 	Snapshot pb.Snapshot
 
+	// Truncated is the range of entries the storage holds that a
+	// conflicting append replaced, empty if none. They must be deleted
+	// before Entries, which rewrite the log from Truncated.Lo, are saved,
+	// or those past the last of Entries come back on restart. A storage
+	// that drops everything after what it appends, like MemoryStorage,
+	// does it already.
+	Truncated LogRange
+
 	// CommittedEntries specifies entries to be committed to a
 	// store/state-machine. These have previously been committed to stable
-	// store.
+	// store, unless Config.AsyncApply is set.
 	CommittedEntries []pb.Entry
 
 	// Messages specifies outbound messages to be sent AFTER Entries are
 	// committed to stable storage.
 	// If it contains a MessageType_MsgSnapshot message, the application MUST report back to raft
 	// when the snapshot has been received or has failed by calling ReportSnapshot.
+	// Messages are handed off once, a later Ready doesn't return them again,
+	// and the slice must not be used after the next Ready.
 	Messages []pb.Message
+
+	// ReadStates can be used for node to serve linearizable read requests locally
+	// when its applied index is greater than the index in ReadState.
+	ReadStates []ReadState
+}
+
+// LogRange is the range of log indexes [Lo, Hi].
+type LogRange struct {
+	Lo, Hi uint64
+}
+
+// Empty reports whether the range holds no index.
+func (lr LogRange) Empty() bool {
+	return lr.Lo == 0 || lr.Hi < lr.Lo
 }
 
 // RawNode is a wrapper of Raft.
@@ -74,8 +104,9 @@ type RawNode struct {
 	// Your Data Here (2A).
 	done      chan struct{}
 	ticker    *time.Ticker
-	hardState pb.HardState
 	softState *SoftState
+	// awake is set by Wake until the leader is heard from
+	awake bool
 }
 
 var TickerInterval = 75 * time.Millisecond
@@ -85,12 +116,13 @@ func NewRawNode(config *Config) (*RawNode, error) {
 	// Your Code Here (2A).
 	node := &RawNode{}
 	node.Raft = newRaft(config)
-	node.ticker = time.NewTicker(TickerInterval)
-	node.hardState = pb.HardState{
-		Term:   node.Raft.Term,
-		Vote:   node.Raft.Vote,
-		Commit: node.Raft.RaftLog.committed,
+	if config.VerifyEntries {
+		if err := node.Raft.RaftLog.verifyEntries(); err != nil {
+			return nil, err
+		}
 	}
+	node.ticker = time.NewTicker(TickerInterval)
+	node.Raft.prevHardSt = node.Raft.hardState()
 
 	node.softState = &SoftState{
 		Lead:      node.Raft.Lead,
@@ -99,11 +131,89 @@ func NewRawNode(config *Config) (*RawNode, error) {
 	return node, nil
 }
 
+// Peer is a member of the initial configuration passed to Bootstrap.
+type Peer struct {
+	ID uint64
+	// Context is set on the peer's conf change as-is.
+	Context []byte
+}
+
+// Bootstrap sets up the initial configuration of a new cluster: it appends
+// and commits one AddNode conf change per peer at term 1, and applies them.
+// The entries are returned in the next Ready to be saved like any other. It
+// refuses a storage that already has a log or a HardState.
+func (rn *RawNode) Bootstrap(peers []Peer) error {
+	if len(peers) == 0 {
+		return errors.New("raft: must provide at least one peer to Bootstrap")
+	}
+	storage := rn.Raft.RaftLog.storage
+	lastIndex, err := storage.LastIndex()
+	if err != nil {
+		return err
+	}
+	hs, _, err := storage.InitialState()
+	if err != nil {
+		return err
+	}
+	if lastIndex != 0 || !IsEmptyHardState(hs) {
+		return errors.New("raft: can't bootstrap a nonempty Storage")
+	}
+
+	rn.Raft.becomeFollower(1, None)
+	ents := make([]pb.Entry, len(peers))
+	for i, peer := range peers {
+		cc := pb.ConfChange{ChangeType: pb.ConfChangeType_AddNode, NodeId: peer.ID, Context: peer.Context}
+		data, err := cc.Marshal()
+		if err != nil {
+			return err
+		}
+		ents[i] = pb.Entry{EntryType: pb.EntryType_EntryConfChange, Term: 1, Index: uint64(i + 1), Data: data}
+	}
+	rn.Raft.RaftLog.append(ents...)
+	// the entries are committed by definition, so the configuration is in
+	// effect right away, applying them again from Ready is a no-op
+	rn.Raft.RaftLog.commitTo(uint64(len(ents)))
+	for _, peer := range peers {
+		rn.ApplyConfChange(pb.ConfChange{ChangeType: pb.ConfChangeType_AddNode, NodeId: peer.ID})
+	}
+	return nil
+}
+
 // Tick advances the internal logical clock by a single tick.
 func (rn *RawNode) Tick() {
 	rn.Raft.tick()
 }
 
+// TickElection advances only the election clock, so failure detection can
+// be driven at a different resolution than heartbeats.
+func (rn *RawNode) TickElection() {
+	rn.Raft.tickElection()
+}
+
+// TickHeartbeat advances only the heartbeat clock, it's a no-op unless this
+// node is the leader.
+func (rn *RawNode) TickHeartbeat() {
+	rn.Raft.tickHeartbeat()
+}
+
+// Quiesced reports whether the host may stop ticking this group until a
+// message arrives for it, see Raft.isQuiesced. It's false after Wake until
+// the leader is heard from again.
+func (rn *RawNode) Quiesced() bool {
+	return !rn.awake && rn.Raft.isQuiesced()
+}
+
+// Wake makes a quiesced group active again, so the host resumes ticking it
+// and a follower still notices a leader that went away. The election timer
+// of a follower is re-armed, so it waits a full timeout from now before it
+// campaigns. Term and Vote are left alone.
+func (rn *RawNode) Wake() {
+	rn.awake = true
+	if rn.Raft.State != StateLeader {
+		rn.Raft.resetElectionTimeOut()
+	}
+}
+
 // Campaign causes this RawNode to transition to candidate state.
 func (rn *RawNode) Campaign() error {
 	return rn.Raft.Step(pb.Message{
@@ -114,23 +224,135 @@ func (rn *RawNode) Campaign() error {
 // Propose proposes data be appended to the raft log.
 func (rn *RawNode) Propose(data []byte) error {
 	ent := pb.Entry{Data: data}
+	return rn.propose([]*pb.Entry{&ent})
+}
+
+// propose steps a proposal of ents. A proposal the leader would drop, see
+// CanPropose for the reasons, returns ErrProposalDropped before anything is
+// stepped, so the caller can fail fast and nothing changes. One that can
+// never be accepted returns ErrMultipleConfChanges.
+func (rn *RawNode) propose(ents []*pb.Entry) error {
+	if err := rn.Raft.dropReason(ents); err != nil {
+		log.Debugf("%s drop proposal: %v", rn.Raft.info(), err)
+		return dropError(err)
+	}
 	return rn.Raft.Step(pb.Message{
 		MsgType: pb.MessageType_MsgPropose,
 		From:    rn.Raft.id,
-		Entries: []*pb.Entry{&ent}})
+		Entries: ents})
+}
+
+// ProposeIndex proposes data like Propose, and returns the index and term of
+// the entry appended for it, to check with IsApplied.
+func (rn *RawNode) ProposeIndex(data []byte) (index, term uint64, err error) {
+	if err := rn.Propose(data); err != nil {
+		return 0, 0, err
+	}
+	return rn.Raft.RaftLog.LastIndex(), rn.Raft.Term, nil
+}
+
+// IsApplied reports whether the entry proposed at index and term, see
+// ProposeIndex, is committed and applied, so a read served by this node's
+// state machine observes the write. Another node may not have applied it
+// yet, so the read must go to this node. ErrProposalDropped is returned if
+// the entry was replaced by another leader's, and ErrCompacted if it can't be
+// told anymore.
+func (rn *RawNode) IsApplied(index, term uint64) (bool, error) {
+	t, err := rn.Raft.RaftLog.Term(index)
+	if errors.Is(err, ErrUnavailable) {
+		// a proposal the leader appended is never beyond the log, unless
+		// it was truncated
+		return false, ErrProposalDropped
+	}
+	if err != nil {
+		return false, err
+	}
+	if t != term {
+		return false, ErrProposalDropped
+	}
+	return rn.Raft.RaftLog.isApplied(index), nil
 }
 
-// ProposeConfChange proposes a config change.
+// BenchBroadcast sends the appends a leader would after a proposal.
+// (Used with Config.BenchMode)
+func (rn *RawNode) BenchBroadcast() {
+	if rn.Raft.State == StateLeader {
+		rn.Raft.bcastAppend(false)
+	}
+}
+
+// ForceCompact discards the log entries in memory up to index, which must be
+// applied and stabled, without waiting for the storage to compact them. The
+// storage's snapshot must already cover index, see RaftLog.forceCompact.
+func (rn *RawNode) ForceCompact(index uint64) error {
+	return rn.Raft.RaftLog.forceCompact(index)
+}
+
+// BenchCommit moves the commit index of a leader to what its followers
+// acked, and reports whether it moved. BenchBroadcast tells them.
+// (Used with Config.BenchMode)
+func (rn *RawNode) BenchCommit() bool {
+	return rn.Raft.State == StateLeader && rn.Raft.maybeCommit()
+}
+
+// ProposeEmpty proposes a normal entry without data, e.g. to move the commit
+// index forward after a membership change or to confirm the leadership once
+// it commits. It's dropped for the same reasons as any other proposal.
+func (rn *RawNode) ProposeEmpty() error {
+	return rn.propose([]*pb.Entry{{EntryType: pb.EntryType_EntryNormal}})
+}
+
+// ProposeBatch proposes all data in a single message, so the leader appends
+// them as contiguous entries and replicates them together.
+func (rn *RawNode) ProposeBatch(datas [][]byte) error {
+	ents := make([]*pb.Entry, 0, len(datas))
+	for _, data := range datas {
+		ents = append(ents, &pb.Entry{Data: data})
+	}
+	return rn.propose(ents)
+}
+
+// CanPropose reports whether a proposal would be accepted now, and if not,
+// the reason it would be dropped. It doesn't propose anything.
+func (rn *RawNode) CanPropose() (bool, error) {
+	return rn.canPropose(false)
+}
+
+// CanProposeConfChange is CanPropose for a conf change, which is also
+// refused while another conf change is pending, but not over MaxLogSize.
+func (rn *RawNode) CanProposeConfChange() (bool, error) {
+	return rn.canPropose(true)
+}
+
+func (rn *RawNode) canPropose(confChange bool) (bool, error) {
+	r := rn.Raft
+	err := r.checkProposal(confChange)
+	if err == nil && !confChange && r.logSizeExceeded(1) {
+		err = ErrLogSizeExceeded
+	}
+	if err == nil && r.maxUncommittedSize > 0 && r.uncommittedSize >= r.maxUncommittedSize {
+		err = ErrUncommittedSizeExceeded
+	}
+	return err == nil, err
+}
+
+// ReadIndex requests a read state. The read state will be set in the ready.
+// Read state has a read index. Once the application advances further than the
+// read index, any linearizable read requests issued before the read request
+// can be processed safely. The read state will have the same rctx attached.
+func (rn *RawNode) ReadIndex(rctx []byte) error {
+	return rn.Raft.readIndex(rctx)
+}
+
+// ProposeConfChange proposes a config change. cc.Context isn't interpreted by
+// raft, it's returned as-is in the committed entry for the application.
 func (rn *RawNode) ProposeConfChange(cc pb.ConfChange) error {
 	data, err := cc.Marshal()
 	if err != nil {
 		return err
 	}
 	ent := pb.Entry{EntryType: pb.EntryType_EntryConfChange, Data: data}
-	return rn.Raft.Step(pb.Message{
-		MsgType: pb.MessageType_MsgPropose,
-		Entries: []*pb.Entry{&ent},
-	})
+	return rn.propose([]*pb.Entry{&ent})
 }
 
 // ApplyConfChange applies a config change to the local node.
@@ -156,17 +378,27 @@ func (rn *RawNode) Step(m pb.Message) error {
 		return ErrStepLocalMsg
 	}
 	if pr := rn.Raft.Prs[m.From]; pr != nil || !IsResponseMsg(m.MsgType) {
-		return rn.Raft.Step(m)
+		err := rn.Raft.Step(m)
+		if err == nil && m.From == rn.Raft.Lead && m.Term == rn.Raft.Term {
+			rn.awake = false
+		}
+		return err
 	}
 	return ErrStepPeerNotFound
 }
 
 // Ready returns the current point-in-time state of this RawNode.
 func (rn *RawNode) Ready() Ready {
+	if o := rn.Raft.observer; o != nil {
+		start := time.Now()
+		defer func() { o.OnReadyDuration(time.Since(start)) }()
+	}
 	r := Ready{
 		Entries:          rn.Raft.RaftLog.unstableEntries(),
+		Truncated:        rn.Raft.RaftLog.truncated,
 		CommittedEntries: rn.Raft.RaftLog.nextEnts(),
-		Messages:         rn.Raft.msgs,
+		Messages:         rn.Raft.readMessages(),
+		ReadStates:       rn.Raft.readStates,
 	}
 
 	if rn.softState.RaftState != rn.Raft.State {
@@ -180,16 +412,28 @@ func (rn *RawNode) Ready() Ready {
 		r.Snapshot = *rn.Raft.RaftLog.pendingSnapshot
 	}
 
-	if rn.hardState.Vote != rn.Raft.Vote || rn.hardState.Term != rn.Raft.Term || rn.hardState.Commit != rn.Raft.RaftLog.committed {
-		r.HardState = pb.HardState{
-			Term:   rn.Raft.Term,
-			Vote:   rn.Raft.Vote,
-			Commit: rn.Raft.RaftLog.committed,
-		}
+	hs := rn.Raft.hardState()
+	if !isHardStateEqual(hs, rn.Raft.prevHardSt) {
+		r.HardState = hs
 	}
+	checkVotesRecorded(hs, r.Messages)
 	return r
 }
 
+// checkVotesRecorded panics if a granted vote in msgs isn't in hs, the
+// HardState persisted before they are sent. A later term supersedes it, the
+// node can't vote in the earlier one anymore.
+func checkVotesRecorded(hs pb.HardState, msgs []pb.Message) {
+	for _, m := range msgs {
+		if m.MsgType != pb.MessageType_MsgRequestVoteResponse || m.Reject {
+			continue
+		}
+		if hs.Term < m.Term || hs.Term == m.Term && hs.Vote != m.To {
+			log.Panicf("vote for %d at term %d is not in the hard state %+v", m.To, m.Term, hs)
+		}
+	}
+}
+
 // HasReady called when RawNode user need to check if any Ready pending.
 func (rn *RawNode) HasReady() bool {
 	// Your Code Here (2A).
@@ -197,6 +441,10 @@ func (rn *RawNode) HasReady() bool {
 		return true
 	}
 
+	if !rn.Raft.RaftLog.truncated.Empty() {
+		return true
+	}
+
 	if len(rn.Raft.RaftLog.nextEnts()) != 0 { // 应用
 		return true
 	}
@@ -205,12 +453,16 @@ func (rn *RawNode) HasReady() bool {
 		return true
 	}
 
-	if len(rn.Raft.msgs) != 0 { // 发送
+	if len(rn.Raft.msgs) != 0 || rn.Raft.proposalsPending || len(rn.Raft.owed) != 0 { // 发送
+		return true
+	}
+
+	if len(rn.Raft.readStates) != 0 { // 读
 		return true
 	}
 
 	// 检查是否有term,vote变化
-	if rn.hardState.Term != rn.Raft.Term || rn.hardState.Vote != rn.Raft.Vote {
+	if !isHardStateEqual(rn.Raft.hardState(), rn.Raft.prevHardSt) {
 		return true
 	}
 
@@ -221,17 +473,34 @@ func (rn *RawNode) HasReady() bool {
 // last Ready results.
 func (rn *RawNode) Advance(rd Ready) {
 	// Your Code Here (2A).
-	if rd.HardState.Commit > rn.hardState.Commit || rd.HardState.Term > rn.hardState.Term || rd.HardState.Vote > rn.hardState.Vote {
-		rn.hardState = rd.HardState
+	if !IsEmptyHardState(rd.HardState) {
+		rn.Raft.prevHardSt = rd.HardState
 	}
 
 	rLog := rn.Raft.RaftLog
-	rLog.applied = max(rn.hardState.Commit, rLog.applied)
+	if !IsEmptySnap(&rd.Snapshot) {
+		rn.Raft.snapshotApplied(rd.Snapshot.Metadata.Index)
+	}
+	if n := len(rd.CommittedEntries); n > 0 {
+		rLog.applied = max(rd.CommittedEntries[n-1].Index, rLog.applied)
+		rn.Raft.reduceUncommittedSize(rd.CommittedEntries)
+	}
 	log.Debugf("Ready: Update applied to %d", rLog.applied)
+	rLog.maybeCompact()
+	// raft asks again on the next send if the snapshot is still being built
+	rLog.snapshotInProgress = false
 	if len(rd.Entries) > 0 {
 		rLog.stabled = max(rLog.stabled, rd.Entries[len(rd.Entries)-1].Index)
 	}
-	rn.Raft.msgs = nil
+	// another conflict since the Ready widens the range, keep it then
+	if rLog.truncated == rd.Truncated {
+		rLog.truncated = LogRange{}
+	}
+	// applied is moved before stabled above, check once both are
+	if !rLog.applyUnstable && rLog.applied > rLog.stabled {
+		log.Panicf("applied(%d) > stabled(%d) without async apply", rLog.applied, rLog.stabled)
+	}
+	rn.Raft.readStates = nil
 	log.Debugf("advance 1")
 }
 
@@ -16,9 +16,11 @@ package raft
 
 import (
 	"bytes"
+	"errors"
 	"github.com/pingcap-incubator/tinykv/log"
 	"reflect"
 	"testing"
+	"time"
 
 	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
 )
@@ -31,6 +33,61 @@ func (s *ignoreSizeHintMemStorage) Entries(lo, hi uint64, maxSize uint64) ([]pb.
 	return s.MemoryStorage.Entries(lo, hi)
 }
 
+func TestIsHardStateEqual2AC(t *testing.T) {
+	tests := []struct {
+		st pb.HardState
+		we bool
+	}{
+		{pb.HardState{}, true},
+		{pb.HardState{Vote: 1}, false},
+		{pb.HardState{Commit: 1}, false},
+		{pb.HardState{Term: 1}, false},
+		{pb.HardState{Term: 1, Vote: 1}, false},
+		{pb.HardState{Term: 1, Commit: 1}, false},
+		{pb.HardState{Vote: 1, Commit: 1}, false},
+		{pb.HardState{Term: 1, Vote: 1, Commit: 1}, false},
+	}
+
+	for i, tt := range tests {
+		if isHardStateEqual(tt.st, pb.HardState{}) != tt.we {
+			t.Errorf("#%d, equal = %v, want %v", i, isHardStateEqual(tt.st, pb.HardState{}), tt.we)
+		}
+		if IsEmptyHardState(tt.st) != tt.we {
+			t.Errorf("#%d, empty = %v, want %v", i, IsEmptyHardState(tt.st), tt.we)
+		}
+		if !isHardStateEqual(tt.st, tt.st) {
+			t.Errorf("#%d, %+v is not equal to itself", i, tt.st)
+		}
+	}
+}
+
+// TestRawNodeHardStateDirty2AC ensures Ready only carries a HardState that
+// differs from the last one handed out.
+func TestRawNodeHardStateDirty2AC(t *testing.T) {
+	s := NewMemoryStorage()
+	s.SetHardState(pb.HardState{Term: 2, Vote: 1})
+	rawNode, err := NewRawNode(newTestConfig(1, []uint64{1, 2}, 10, 1, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rd := rawNode.Ready(); !IsEmptyHardState(rd.HardState) {
+		t.Fatalf("hardState = %+v, want empty on restart", rd.HardState)
+	}
+
+	rawNode.Raft.becomeFollower(3, 2)
+	rd := rawNode.Ready()
+	if w := (pb.HardState{Term: 3}); !isHardStateEqual(rd.HardState, w) {
+		t.Fatalf("hardState = %+v, want %+v", rd.HardState, w)
+	}
+	rawNode.Advance(rd)
+	if rawNode.HasReady() {
+		t.Errorf("unexpected Ready: %+v", rawNode.Ready())
+	}
+	if rd := rawNode.Ready(); !IsEmptyHardState(rd.HardState) {
+		t.Errorf("hardState = %+v, want empty", rd.HardState)
+	}
+}
+
 // TestRawNodeProposeAndConfChange ensures that RawNode.Propose and RawNode.ProposeConfChange
 // send the given proposal and ConfChange to the underlying raft.
 func TestRawNodeProposeAndConfChange3A(t *testing.T) {
@@ -80,6 +137,465 @@ func TestRawNodeProposeAndConfChange3A(t *testing.T) {
 	}
 }
 
+// TestRawNodeProposeBatch2AB ensures that a batch of proposals becomes
+// contiguous entries at the leader's term, sent in one append per follower.
+func TestRawNodeProposeBatch2AB(t *testing.T) {
+	s := NewMemoryStorage()
+	rawNode, err := NewRawNode(newTestConfig(1, []uint64{1, 2, 3}, 10, 1, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawNode.Campaign()
+	rawNode.Step(pb.Message{From: 2, To: 1, Term: 1, MsgType: pb.MessageType_MsgRequestVoteResponse})
+	if rawNode.Raft.State != StateLeader {
+		t.Fatalf("state = %s, want %s", rawNode.Raft.State, StateLeader)
+	}
+	// both followers have the no-op, so the batch is all that's left to send
+	rawNode.Step(pb.Message{From: 2, To: 1, Term: 1, MsgType: pb.MessageType_MsgAppendResponse, Index: 1})
+	rawNode.Step(pb.Message{From: 3, To: 1, Term: 1, MsgType: pb.MessageType_MsgAppendResponse, Index: 1})
+	rd := rawNode.Ready()
+	s.Append(rd.Entries)
+	rawNode.Advance(rd)
+
+	datas := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	if err := rawNode.ProposeBatch(datas); err != nil {
+		t.Fatal(err)
+	}
+	rd = rawNode.Ready()
+	if len(rd.Entries) != len(datas) {
+		t.Fatalf("len(entries) = %d, want %d", len(rd.Entries), len(datas))
+	}
+	for i, ent := range rd.Entries {
+		if ent.Index != uint64(i+2) || ent.Term != 1 || !bytes.Equal(ent.Data, datas[i]) {
+			t.Errorf("#%d: entry = %+v, want index %d term 1 data %s", i, ent, i+2, datas[i])
+		}
+	}
+	if len(rd.Messages) != 2 {
+		t.Fatalf("len(msgs) = %d, want 2", len(rd.Messages))
+	}
+	for _, m := range rd.Messages {
+		if m.MsgType != pb.MessageType_MsgAppend || len(m.Entries) != len(datas) {
+			t.Errorf("msg = %+v, want one append with %d entries", m, len(datas))
+		}
+	}
+}
+
+// TestRawNodeProposeBatchUncommittedLimit2AB ensures a batch is dropped as a
+// whole when it would go over MaxUncommittedEntriesSize.
+func TestRawNodeProposeBatchUncommittedLimit2AB(t *testing.T) {
+	s := NewMemoryStorage()
+	c := newTestConfig(1, []uint64{1, 2}, 10, 1, s)
+	c.MaxUncommittedEntriesSize = 4
+	rawNode, err := NewRawNode(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawNode.Campaign()
+	rawNode.Step(pb.Message{From: 2, To: 1, Term: 1, MsgType: pb.MessageType_MsgRequestVoteResponse})
+	rd := rawNode.Ready()
+	s.Append(rd.Entries)
+	rawNode.Advance(rd)
+
+	if err := rawNode.ProposeBatch([][]byte{[]byte("ab"), []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	last := rawNode.Raft.RaftLog.LastIndex()
+	if err := rawNode.ProposeBatch([][]byte{[]byte("d"), []byte("e")}); err != ErrProposalDropped {
+		t.Fatalf("err = %v, want %v", err, ErrProposalDropped)
+	}
+	if l := rawNode.Raft.RaftLog.LastIndex(); l != last {
+		t.Errorf("lastIndex = %d, want %d", l, last)
+	}
+
+	// once the entries commit and are applied the size is released
+	rd = rawNode.Ready()
+	s.Append(rd.Entries)
+	rawNode.Advance(rd)
+	rawNode.Step(pb.Message{From: 2, To: 1, Term: 1, MsgType: pb.MessageType_MsgAppendResponse, Index: last})
+	rd = rawNode.Ready()
+	rawNode.Advance(rd)
+	if err := rawNode.ProposeBatch([][]byte{[]byte("d"), []byte("e")}); err != nil {
+		t.Errorf("err = %v, want nil", err)
+	}
+}
+
+// TestRawNodeMessagesFlushOnce2AB ensures that messages are handed off once,
+// two consecutive flushes don't return the same messages.
+func TestRawNodeMessagesFlushOnce2AB(t *testing.T) {
+	s := NewMemoryStorage()
+	rawNode, err := NewRawNode(newTestConfig(1, []uint64{1, 2, 3}, 10, 1, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawNode.Campaign()
+	rd := rawNode.Ready()
+	if len(rd.Messages) != 2 {
+		t.Fatalf("len(msgs) = %d, want 2", len(rd.Messages))
+	}
+	if rd = rawNode.Ready(); len(rd.Messages) != 0 {
+		t.Errorf("msgs = %+v, want none", rd.Messages)
+	}
+	rawNode.Advance(rd)
+
+	r := rawNode.Raft
+	r.send(pb.Message{To: 2, MsgType: pb.MessageType_MsgRequestVote})
+	first := r.readMessages()
+	if len(first) != 1 || first[0].To != 2 {
+		t.Fatalf("msgs = %+v, want one to 2", first)
+	}
+	r.send(pb.Message{To: 3, MsgType: pb.MessageType_MsgRequestVote})
+	second := r.readMessages()
+	if len(second) != 1 || second[0].To != 3 {
+		t.Errorf("msgs = %+v, want one to 3", second)
+	}
+	if msgs := r.readMessages(); len(msgs) != 0 {
+		t.Errorf("msgs = %+v, want none", msgs)
+	}
+}
+
+// TestRawNodeTickElection2AA ensures that driving only the election clock
+// advances it on a leader without sending heartbeats.
+func TestRawNodeTickElection2AA(t *testing.T) {
+	s := NewMemoryStorage()
+	c := newTestConfig(1, []uint64{1, 2}, 10, 1, s)
+	c.CheckQuorum = true
+	rawNode, err := NewRawNode(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rawNode.Raft
+	r.becomeCandidate()
+	r.becomeLeader()
+	r.readMessages()
+
+	for i := 0; i < 5; i++ {
+		rawNode.TickElection()
+	}
+	if r.electionElapsed != 5 {
+		t.Errorf("electionElapsed = %d, want 5", r.electionElapsed)
+	}
+	if msgs := r.readMessages(); len(msgs) != 0 {
+		t.Errorf("msgs = %+v, want no heartbeat", msgs)
+	}
+
+	// the quorum check still runs on the election clock
+	for i := 0; i < 5; i++ {
+		rawNode.TickElection()
+	}
+	if r.State != StateFollower {
+		t.Errorf("state = %s, want %s", r.State, StateFollower)
+	}
+
+	rawNode.TickHeartbeat()
+	if msgs := r.readMessages(); len(msgs) != 0 {
+		t.Errorf("msgs = %+v, want none from a follower", msgs)
+	}
+}
+
+// TestRawNodeProposeEmpty2AB ensures ProposeEmpty appends a single empty
+// normal entry and broadcasts it, and is dropped while transferring.
+func TestRawNodeProposeEmpty2AB(t *testing.T) {
+	rawNode, err := NewRawNode(newTestConfig(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawNode.Raft.becomeCandidate()
+	rawNode.Raft.becomeLeader()
+	rawNode.Raft.readMessages()
+	lastIndex := rawNode.Raft.RaftLog.LastIndex()
+
+	if err := rawNode.ProposeEmpty(); err != nil {
+		t.Fatal(err)
+	}
+	l := rawNode.Raft.RaftLog
+	if g := l.LastIndex(); g != lastIndex+1 {
+		t.Fatalf("lastIndex = %d, want %d", g, lastIndex+1)
+	}
+	e, _ := l.entryAt(lastIndex + 1)
+	if e.EntryType != pb.EntryType_EntryNormal || len(e.Data) != 0 || e.Term != 1 {
+		t.Errorf("entry = %+v, want an empty normal entry at term 1", e)
+	}
+	msgs := rawNode.Raft.readMessages()
+	if len(msgs) != 2 {
+		t.Fatalf("len(msgs) = %d, want 2", len(msgs))
+	}
+	for _, m := range msgs {
+		if m.MsgType != pb.MessageType_MsgAppend || len(m.Entries) == 0 || m.Entries[len(m.Entries)-1].Index != lastIndex+1 {
+			t.Errorf("msg = %+v, want an append ending at %d", m, lastIndex+1)
+		}
+	}
+
+	// 2 is behind, the transfer waits for it to catch up
+	rawNode.TransferLeader(2)
+	rawNode.Raft.readMessages()
+	if err := rawNode.ProposeEmpty(); err != ErrProposalDropped {
+		t.Errorf("propose while transferring = %v, want %v", err, ErrProposalDropped)
+	}
+	if g := l.LastIndex(); g != lastIndex+1 {
+		t.Errorf("lastIndex = %d, want %d", g, lastIndex+1)
+	}
+}
+
+// TestRawNodeReadYourWrites2AB ensures a write is observed once IsApplied
+// reports the entry applied, and that a lost proposal is reported dropped.
+func TestRawNodeReadYourWrites2AB(t *testing.T) {
+	s := NewMemoryStorage()
+	rawNode, err := NewRawNode(newTestConfig(1, []uint64{1}, 10, 1, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := map[string]bool{}
+	handle := func() {
+		for rawNode.HasReady() {
+			rd := rawNode.Ready()
+			s.Append(rd.Entries)
+			for _, e := range rd.CommittedEntries {
+				if len(e.Data) > 0 {
+					kv[string(e.Data)] = true
+				}
+			}
+			rawNode.Advance(rd)
+		}
+	}
+	rawNode.Campaign()
+	handle()
+
+	index, term, err := rawNode.ProposeIndex([]byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := rawNode.IsApplied(index, term); ok || err != nil {
+		t.Errorf("applied before Ready = %v, %v, want false, nil", ok, err)
+	}
+	handle()
+	if ok, err := rawNode.IsApplied(index, term); !ok || err != nil {
+		t.Fatalf("applied = %v, %v, want true, nil", ok, err)
+	}
+	if !kv["foo"] {
+		t.Errorf("read after applied doesn't observe the write")
+	}
+
+	if _, err := rawNode.IsApplied(index, term+1); err != ErrProposalDropped {
+		t.Errorf("replaced entry: err = %v, want %v", err, ErrProposalDropped)
+	}
+	if _, err := rawNode.IsApplied(index+1, term); err != ErrProposalDropped {
+		t.Errorf("truncated entry: err = %v, want %v", err, ErrProposalDropped)
+	}
+}
+
+// TestRawNodeCanPropose3A ensures that CanPropose reports each reason a
+// proposal would be dropped, without proposing anything.
+func TestRawNodeCanPropose3A(t *testing.T) {
+	s := NewMemoryStorage()
+	rawNode, err := NewRawNode(newTestConfig(1, []uint64{1, 2}, 10, 1, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(name string, can func() (bool, error), werr error) {
+		ok, err := can()
+		if ok != (werr == nil) || err != werr {
+			t.Errorf("%s = %v, %v, want %v, %v", name, ok, err, werr == nil, werr)
+		}
+	}
+
+	check("follower", rawNode.CanPropose, ErrNotLeader)
+	check("follower conf change", rawNode.CanProposeConfChange, ErrNotLeader)
+
+	rawNode.Raft.becomeCandidate()
+	rawNode.Raft.becomeLeader()
+	check("leader", rawNode.CanPropose, nil)
+	check("leader conf change", rawNode.CanProposeConfChange, nil)
+	lastIndex := rawNode.Raft.RaftLog.LastIndex()
+
+	if err := rawNode.ProposeConfChange(pb.ConfChange{ChangeType: pb.ConfChangeType_AddNode, NodeId: 3}); err != nil {
+		t.Fatal(err)
+	}
+	check("pending conf change", rawNode.CanPropose, nil)
+	check("second conf change", rawNode.CanProposeConfChange, ErrConfChangePending)
+	if err := rawNode.ProposeConfChange(pb.ConfChange{ChangeType: pb.ConfChangeType_AddNode, NodeId: 4}); err != ErrProposalDropped {
+		t.Errorf("propose second conf change = %v, want %v", err, ErrProposalDropped)
+	}
+
+	// 2 is behind, the transfer waits for it to catch up
+	rawNode.TransferLeader(2)
+	check("transferring", rawNode.CanPropose, ErrLeaderTransferring)
+	check("transferring conf change", rawNode.CanProposeConfChange, ErrLeaderTransferring)
+	if g := rawNode.Raft.RaftLog.LastIndex(); g != lastIndex+1 {
+		t.Errorf("lastIndex = %d, want %d, only the first conf change is appended", g, lastIndex+1)
+	}
+
+	c := newTestConfig(1, []uint64{1}, 10, 1, NewMemoryStorage())
+	c.MaxUncommittedEntriesSize = 8
+	rawNode, err = NewRawNode(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawNode.Raft.becomeCandidate()
+	rawNode.Raft.becomeLeader()
+	if err := rawNode.Propose([]byte("somedata")); err != nil {
+		t.Fatal(err)
+	}
+	check("budget exhausted", rawNode.CanPropose, ErrUncommittedSizeExceeded)
+}
+
+// TestRawNodeProposeDropped3A ensures that a proposal dropped for each reason
+// returns ErrProposalDropped right away, and leaves the log, the uncommitted
+// size and the messages as they were.
+func TestRawNodeProposeDropped3A(t *testing.T) {
+	newNode := func(peers []uint64, lead bool, maxUncommitted uint64) *RawNode {
+		c := newTestConfig(1, peers, 10, 1, NewMemoryStorage())
+		c.MaxUncommittedEntriesSize = maxUncommitted
+		rawNode, err := NewRawNode(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lead {
+			rawNode.Raft.becomeCandidate()
+			rawNode.Raft.becomeLeader()
+		}
+		return rawNode
+	}
+	cc := pb.ConfChange{ChangeType: pb.ConfChangeType_AddNode, NodeId: 3}
+
+	tests := []struct {
+		name    string
+		rawNode *RawNode
+		setup   func(rn *RawNode)
+		propose func(rn *RawNode) error
+	}{
+		{"follower", newNode([]uint64{1, 2}, false, 0), func(rn *RawNode) {},
+			func(rn *RawNode) error { return rn.Propose([]byte("somedata")) }},
+		{"follower conf change", newNode([]uint64{1, 2}, false, 0), func(rn *RawNode) {},
+			func(rn *RawNode) error { return rn.ProposeConfChange(cc) }},
+		// 2 is behind, the transfer waits for it to catch up
+		{"transferring", newNode([]uint64{1, 2}, true, 0), func(rn *RawNode) { rn.TransferLeader(2) },
+			func(rn *RawNode) error { return rn.ProposeBatch([][]byte{[]byte("a"), []byte("b")}) }},
+		{"conf change pending", newNode([]uint64{1, 2}, true, 0),
+			func(rn *RawNode) {
+				if err := rn.ProposeConfChange(cc); err != nil {
+					t.Fatal(err)
+				}
+			},
+			func(rn *RawNode) error {
+				return rn.ProposeConfChange(pb.ConfChange{ChangeType: pb.ConfChangeType_AddNode, NodeId: 4})
+			}},
+		{"budget exhausted", newNode([]uint64{1, 2}, true, 8),
+			func(rn *RawNode) {
+				if err := rn.Propose([]byte("somedata")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			func(rn *RawNode) error { return rn.Propose([]byte("x")) }},
+	}
+	for _, tt := range tests {
+		rn := tt.rawNode
+		tt.setup(rn)
+		rn.Raft.readMessages()
+		lastIndex, uncommitted := rn.Raft.RaftLog.LastIndex(), rn.Raft.uncommittedSize
+		if err := tt.propose(rn); err != ErrProposalDropped {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, ErrProposalDropped)
+		}
+		if g := rn.Raft.RaftLog.LastIndex(); g != lastIndex {
+			t.Errorf("%s: lastIndex = %d, want %d", tt.name, g, lastIndex)
+		}
+		if g := rn.Raft.uncommittedSize; g != uncommitted {
+			t.Errorf("%s: uncommittedSize = %d, want %d", tt.name, g, uncommitted)
+		}
+		if msgs := rn.Raft.readMessages(); len(msgs) != 0 {
+			t.Errorf("%s: msgs = %+v, want none", tt.name, msgs)
+		}
+	}
+}
+
+// TestRawNodeTruncatedRange2AB ensures that after a conflicting append the
+// Ready reports the stabled entries it replaced, and that a node restarting
+// from the storage saved that way reads the corrected log.
+func TestRawNodeTruncatedRange2AB(t *testing.T) {
+	s := NewMemoryStorage()
+	s.Append([]pb.Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2}, {Term: 1, Index: 3}, {Term: 1, Index: 4}, {Term: 1, Index: 5}})
+	s.SetHardState(pb.HardState{Term: 1, Commit: 2})
+	rawNode, err := NewRawNode(newTestConfig(1, []uint64{1, 2}, 10, 1, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := rawNode.Raft.RaftLog.Stabled(); g != 5 {
+		t.Fatalf("stabled = %d, want 5", g)
+	}
+
+	rawNode.Step(pb.Message{From: 2, To: 1, Term: 2, MsgType: pb.MessageType_MsgAppend, LogTerm: 1, Index: 2, Commit: 2,
+		Entries: []*pb.Entry{{Term: 2, Index: 3}}})
+	rd := rawNode.Ready()
+	if w := (LogRange{Lo: 3, Hi: 5}); rd.Truncated != w {
+		t.Errorf("truncated = %+v, want %+v", rd.Truncated, w)
+	}
+	if len(rd.Entries) != 1 || rd.Entries[0].Index != rd.Truncated.Lo {
+		t.Errorf("entries = %+v, want the rewrite from %d", rd.Entries, rd.Truncated.Lo)
+	}
+	s.Append(rd.Entries)
+	s.SetHardState(rd.HardState)
+	rawNode.Advance(rd)
+	if rawNode.HasReady() {
+		if rd = rawNode.Ready(); !rd.Truncated.Empty() {
+			t.Errorf("truncated = %+v after Advance, want empty", rd.Truncated)
+		}
+	}
+
+	restarted, err := NewRawNode(newTestConfig(1, []uint64{1, 2}, 10, 1, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := restarted.Raft.RaftLog
+	if l.LastIndex() != 3 || l.LastTerm() != 2 || l.Stabled() != 3 {
+		t.Errorf("last index, term, stabled = %d, %d, %d, want 3, 2, 3", l.LastIndex(), l.LastTerm(), l.Stabled())
+	}
+}
+
+// TestRawNodeConfChangeContext3A ensures the context of a conf change comes
+// back unchanged in the committed entry that is applied.
+func TestRawNodeConfChangeContext3A(t *testing.T) {
+	s := NewMemoryStorage()
+	rawNode, err := NewRawNode(newTestConfig(1, []uint64{1}, 10, 1, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawNode.Campaign()
+	rd := rawNode.Ready()
+	s.Append(rd.Entries)
+	rawNode.Advance(rd)
+
+	ctx := []byte("127.0.0.1:20160")
+	if err := rawNode.ProposeConfChange(pb.ConfChange{ChangeType: pb.ConfChangeType_AddNode, NodeId: 2, Context: ctx}); err != nil {
+		t.Fatal(err)
+	}
+	var applied []pb.ConfChange
+	for rawNode.HasReady() {
+		rd = rawNode.Ready()
+		s.Append(rd.Entries)
+		for _, entry := range rd.CommittedEntries {
+			if entry.EntryType != pb.EntryType_EntryConfChange {
+				continue
+			}
+			var cc pb.ConfChange
+			if err := cc.Unmarshal(entry.Data); err != nil {
+				t.Fatal(err)
+			}
+			rawNode.ApplyConfChange(cc)
+			applied = append(applied, cc)
+		}
+		rawNode.Advance(rd)
+	}
+
+	if len(applied) != 1 {
+		t.Fatalf("applied %d conf changes, want 1", len(applied))
+	}
+	if !bytes.Equal(applied[0].Context, ctx) || applied[0].NodeId != 2 {
+		t.Errorf("conf change = %+v, want node 2 with context %q", applied[0], ctx)
+	}
+	if g := nodes(rawNode.Raft); !reflect.DeepEqual(g, []uint64{1, 2}) {
+		t.Errorf("nodes = %v, want [1 2]", g)
+	}
+}
+
 // TestRawNodeProposeAddDuplicateNode ensures that two proposes to add the same node should
 // not affect the later propose to add new node.
 func TestRawNodeProposeAddDuplicateNode3A(t *testing.T) {
@@ -105,16 +621,19 @@ func TestRawNodeProposeAddDuplicateNode3A(t *testing.T) {
 
 	proposeConfChangeAndApply := func(cc pb.ConfChange) {
 		rawNode.ProposeConfChange(cc)
-		rd = rawNode.Ready()
-		s.Append(rd.Entries)
-		for _, entry := range rd.CommittedEntries {
-			if entry.EntryType == pb.EntryType_EntryConfChange {
-				var cc pb.ConfChange
-				cc.Unmarshal(entry.Data)
-				rawNode.ApplyConfChange(cc)
+		// the entry is applied in the Ready after the one that stables it
+		for rawNode.HasReady() {
+			rd = rawNode.Ready()
+			s.Append(rd.Entries)
+			for _, entry := range rd.CommittedEntries {
+				if entry.EntryType == pb.EntryType_EntryConfChange {
+					var cc pb.ConfChange
+					cc.Unmarshal(entry.Data)
+					rawNode.ApplyConfChange(cc)
+				}
 			}
+			rawNode.Advance(rd)
 		}
-		rawNode.Advance(rd)
 	}
 
 	cc1 := pb.ConfChange{ChangeType: pb.ConfChangeType_AddNode, NodeId: 1}
@@ -156,6 +675,127 @@ func TestRawNodeProposeAddDuplicateNode3A(t *testing.T) {
 	}
 }
 
+// TestRawNodeBootstrap3A ensures Bootstrap commits one conf change per peer,
+// telling OnCommitted, and the node comes up with that membership, and that a
+// storage in use is refused.
+func TestRawNodeBootstrap3A(t *testing.T) {
+	s := NewMemoryStorage()
+	cfg := newTestConfig(1, nil, 10, 1, s)
+	var committed []uint64
+	cfg.OnCommitted = func(index uint64) { committed = append(committed, index) }
+	rawNode, err := NewRawNode(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rawNode.Bootstrap(nil); err == nil {
+		t.Error("bootstrap without peers: want error")
+	}
+	peers := []Peer{{ID: 1}, {ID: 2, Context: []byte("2")}, {ID: 3}}
+	if err := rawNode.Bootstrap(peers); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(committed, []uint64{3}) {
+		t.Errorf("OnCommitted calls = %v, want [3]", committed)
+	}
+	if g := nodes(rawNode.Raft); !reflect.DeepEqual(g, []uint64{1, 2, 3}) {
+		t.Errorf("nodes = %v, want [1 2 3]", g)
+	}
+
+	rd := rawNode.Ready()
+	if w := (pb.HardState{Term: 1, Commit: 3}); !isHardStateEqual(rd.HardState, w) {
+		t.Errorf("hardState = %+v, want %+v", rd.HardState, w)
+	}
+	if len(rd.Entries) != 3 || len(rd.CommittedEntries) != 0 {
+		t.Fatalf("entries = %+v, committed = %+v, want 3 entries to stable first", rd.Entries, rd.CommittedEntries)
+	}
+	s.Append(rd.Entries)
+	s.SetHardState(rd.HardState)
+	rawNode.Advance(rd)
+	ents := rd.Entries
+	rd = rawNode.Ready()
+	if !reflect.DeepEqual(rd.CommittedEntries, ents) {
+		t.Fatalf("committed = %+v, want %+v", rd.CommittedEntries, ents)
+	}
+	for i, e := range rd.CommittedEntries {
+		var cc pb.ConfChange
+		if err := cc.Unmarshal(e.Data); err != nil {
+			t.Fatal(err)
+		}
+		if e.EntryType != pb.EntryType_EntryConfChange || e.Term != 1 || e.Index != uint64(i+1) {
+			t.Errorf("#%d: entry = %+v, want a conf change at term 1 index %d", i, e, i+1)
+		}
+		if cc.ChangeType != pb.ConfChangeType_AddNode || cc.NodeId != peers[i].ID || !bytes.Equal(cc.Context, peers[i].Context) {
+			t.Errorf("#%d: conf change = %+v, want add node %d", i, cc, peers[i].ID)
+		}
+		rawNode.ApplyConfChange(cc)
+	}
+	rawNode.Advance(rd)
+	if g := nodes(rawNode.Raft); !reflect.DeepEqual(g, []uint64{1, 2, 3}) {
+		t.Errorf("nodes after apply = %v, want [1 2 3]", g)
+	}
+
+	// the storage now has a log
+	rawNode, err = NewRawNode(newTestConfig(1, nil, 10, 1, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rawNode.Bootstrap(peers); err == nil {
+		t.Error("bootstrap a nonempty storage: want error")
+	}
+}
+
+// TestRawNodeApplyAfterStable2AC ensures committed entries are only handed
+// out for apply once they're stabled, unless AsyncApply is set.
+func TestRawNodeApplyAfterStable2AC(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		storage := NewMemoryStorage()
+		c := newTestConfig(1, []uint64{1}, 10, 1, storage)
+		c.AsyncApply = async
+		rawNode, err := NewRawNode(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawNode.Campaign()
+		for rawNode.HasReady() {
+			rd := rawNode.Ready()
+			storage.Append(rd.Entries)
+			rawNode.Advance(rd)
+		}
+
+		rawNode.Propose([]byte("foo"))
+		l := rawNode.Raft.RaftLog
+		if l.committed <= l.stabled {
+			t.Fatalf("async %v: committed = %d, stabled = %d, want the entry committed but unstable", async, l.committed, l.stabled)
+		}
+		var visited int
+		l.forEachCommitted(func(e *pb.Entry) bool {
+			visited++
+			return true
+		})
+		rd := rawNode.Ready()
+		wn := 0
+		if async {
+			wn = 1
+		}
+		if len(rd.Entries) != 1 || len(rd.CommittedEntries) != wn || visited != wn {
+			t.Errorf("async %v: entries = %d, committed = %d, visited = %d, want 1, %d, %d", async, len(rd.Entries), len(rd.CommittedEntries), visited, wn, wn)
+		}
+		storage.Append(rd.Entries)
+		rawNode.Advance(rd)
+
+		if !async {
+			rd = rawNode.Ready()
+			if len(rd.CommittedEntries) != 1 || !bytes.Equal(rd.CommittedEntries[0].Data, []byte("foo")) {
+				t.Errorf("committed after stable = %+v, want foo", rd.CommittedEntries)
+			}
+			rawNode.Advance(rd)
+		}
+		if rawNode.HasReady() {
+			t.Errorf("async %v: unexpected Ready: %+v", async, rawNode.Ready())
+		}
+	}
+}
+
 // TestRawNodeStart ensures that a node can be started correctly, and can accept and commit
 // proposals.
 func TestRawNodeStart2AC(t *testing.T) {
@@ -166,27 +806,72 @@ func TestRawNodeStart2AC(t *testing.T) {
 		t.Fatal(err)
 	}
 	rawNode.Campaign()
-	rd := rawNode.Ready()
-	log.Errorf("rd: %+v", rd)
-	storage.Append(rd.Entries)
-	rawNode.Advance(rd)
+	var rd Ready
+	for rawNode.HasReady() {
+		rd = rawNode.Ready()
+		log.Errorf("rd: %+v", rd)
+		storage.Append(rd.Entries)
+		rawNode.Advance(rd)
+	}
 
 	rawNode.Propose([]byte("foo"))
 	rd = rawNode.Ready()
-	if el := len(rd.Entries); el != len(rd.CommittedEntries) || el != 1 {
-		t.Errorf("got len(Entries): %+v, len(CommittedEntries): %+v, want %+v", el, len(rd.CommittedEntries), 1)
-	}
-	if !reflect.DeepEqual(rd.Entries[0].Data, rd.CommittedEntries[0].Data) || !reflect.DeepEqual(rd.Entries[0].Data, []byte("foo")) {
-		t.Errorf("got %+v %+v , want %+v", rd.Entries[0].Data, rd.CommittedEntries[0].Data, []byte("foo"))
+	if el := len(rd.Entries); el != 1 || len(rd.CommittedEntries) != 0 {
+		t.Fatalf("got len(Entries): %+v, len(CommittedEntries): %+v, want 1, 0", el, len(rd.CommittedEntries))
 	}
 	storage.Append(rd.Entries)
 	rawNode.Advance(rd)
+	// the entry is applied once it's stabled
+	ents := rd.Entries
+	rd = rawNode.Ready()
+	if len(rd.CommittedEntries) != 1 || !reflect.DeepEqual(ents[0].Data, rd.CommittedEntries[0].Data) || !reflect.DeepEqual(ents[0].Data, []byte("foo")) {
+		t.Errorf("got %+v %+v , want %+v", ents[0].Data, rd.CommittedEntries, []byte("foo"))
+	}
+	rawNode.Advance(rd)
 
 	if rawNode.HasReady() {
 		t.Errorf("unexpected Ready: %+v", rawNode.Ready())
 	}
 }
 
+// TestRawNodeVoteInHardState2AA ensures a granted vote is handed out with the
+// HardState that records it, so a node that persisted it and crashed before
+// sending the response doesn't vote again in the term.
+func TestRawNodeVoteInHardState2AA(t *testing.T) {
+	s := NewMemoryStorage()
+	rawNode, err := NewRawNode(newTestConfig(1, []uint64{1, 2, 3}, 10, 1, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawNode.Step(pb.Message{From: 2, To: 1, Term: 2, MsgType: pb.MessageType_MsgRequestVote})
+	rd := rawNode.Ready()
+	if len(rd.Messages) != 1 || rd.Messages[0].MsgType != pb.MessageType_MsgRequestVoteResponse || rd.Messages[0].Reject {
+		t.Fatalf("msgs = %+v, want a granted vote", rd.Messages)
+	}
+	if w := (pb.HardState{Term: 2, Vote: 2}); !isHardStateEqual(rd.HardState, w) {
+		t.Fatalf("hardState = %+v, want %+v", rd.HardState, w)
+	}
+	// persisted, then crashed before the response went out
+	s.SetHardState(rd.HardState)
+
+	rawNode, err = NewRawNode(newTestConfig(1, []uint64{1, 2, 3}, 10, 1, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawNode.Step(pb.Message{From: 3, To: 1, Term: 2, MsgType: pb.MessageType_MsgRequestVote})
+	rd = rawNode.Ready()
+	if len(rd.Messages) != 1 || !rd.Messages[0].Reject {
+		t.Errorf("msgs = %+v, want the vote for 3 rejected", rd.Messages)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("vote missing from the hard state: want panic")
+		}
+	}()
+	checkVotesRecorded(pb.HardState{Term: 2, Vote: 3}, []pb.Message{{MsgType: pb.MessageType_MsgRequestVoteResponse, To: 2, Term: 2}})
+}
+
 func TestRawNodeRestart2AC(t *testing.T) {
 	entries := []pb.Entry{
 		{Term: 1, Index: 1},
@@ -253,3 +938,365 @@ func TestRawNodeRestartFromSnapshot2C(t *testing.T) {
 		t.Errorf("unexpected Ready: %+v", rawNode.HasReady())
 	}
 }
+
+// TestRawNodeSnapshotRetry2C tests that a received snapshot is returned in
+// Ready until the application confirms it in Advance, and only then raft
+// moves applied to the snapshot.
+func TestRawNodeSnapshotRetry2C(t *testing.T) {
+	s := NewMemoryStorage()
+	rawNode, err := NewRawNode(newTestConfig(2, []uint64{1, 2}, 10, 1, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := pb.Snapshot{
+		Metadata: &pb.SnapshotMetadata{
+			ConfState: &pb.ConfState{Nodes: []uint64{1, 2}},
+			Index:     11,
+			Term:      2,
+		},
+	}
+	rawNode.Step(pb.Message{From: 1, To: 2, Term: 2, MsgType: pb.MessageType_MsgSnapshot, Snapshot: &snap})
+
+	// the application fails to persist the snapshot and doesn't advance.
+	rd := rawNode.Ready()
+	if IsEmptySnap(&rd.Snapshot) || rd.Snapshot.Metadata.Index != 11 {
+		t.Fatalf("snapshot = %+v, want index 11", rd.Snapshot)
+	}
+	if applied := rawNode.Raft.RaftLog.applied; applied != 0 {
+		t.Fatalf("applied = %d, want 0 before the snapshot is confirmed", applied)
+	}
+
+	// it retries, the same snapshot is surfaced again.
+	if !rawNode.HasReady() {
+		t.Fatal("expected Ready with the pending snapshot")
+	}
+	rd = rawNode.Ready()
+	if IsEmptySnap(&rd.Snapshot) || rd.Snapshot.Metadata.Index != 11 {
+		t.Fatalf("snapshot = %+v, want index 11", rd.Snapshot)
+	}
+	if err := s.ApplySnapshot(rd.Snapshot); err != nil {
+		t.Fatal(err)
+	}
+	rawNode.Advance(rd)
+
+	if applied := rawNode.Raft.RaftLog.applied; applied != 11 {
+		t.Errorf("applied = %d, want 11", applied)
+	}
+	if rawNode.Raft.RaftLog.pendingSnapshot != nil {
+		t.Errorf("pendingSnapshot = %+v, want nil", rawNode.Raft.RaftLog.pendingSnapshot)
+	}
+	if rd = rawNode.Ready(); !IsEmptySnap(&rd.Snapshot) {
+		t.Errorf("snapshot = %+v, want empty", rd.Snapshot)
+	}
+}
+
+// TestRawNodeSnapshotUnconfirmed2C tests that until the application confirms
+// a received snapshot in Advance, the log keeps its bounds and the leader
+// isn't acked, so nothing claims the snapshot is on disk.
+func TestRawNodeSnapshotUnconfirmed2C(t *testing.T) {
+	s := NewMemoryStorage()
+	s.Append([]pb.Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2}, {Term: 1, Index: 3}})
+	s.SetHardState(pb.HardState{Term: 1, Commit: 3})
+	rawNode, err := NewRawNode(newTestConfig(2, []uint64{1, 2}, 10, 1, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap := pb.Snapshot{Metadata: &pb.SnapshotMetadata{ConfState: &pb.ConfState{Nodes: []uint64{1, 2}}, Index: 11, Term: 2}}
+	rawNode.Step(pb.Message{From: 1, To: 2, Term: 2, MsgType: pb.MessageType_MsgSnapshot, Snapshot: &snap})
+
+	// the Ready is never advanced, e.g. persisting the snapshot failed
+	for i := 0; i < 2; i++ {
+		rd := rawNode.Ready()
+		if rd.Snapshot.Metadata == nil || rd.Snapshot.Metadata.Index != 11 {
+			t.Fatalf("#%d: snapshot = %+v, want index 11", i, rd.Snapshot)
+		}
+		if len(rd.Messages) != 0 {
+			t.Errorf("#%d: msgs = %+v, want no ack before Advance", i, rd.Messages)
+		}
+		if rd.HardState.Commit > 3 {
+			t.Errorf("#%d: hard state commit = %d, want at most 3", i, rd.HardState.Commit)
+		}
+		l := rawNode.Raft.RaftLog
+		if l.start != 0 || l.committed != 3 || l.stabled != 3 || l.applied != 0 || l.LastIndex() != 3 {
+			t.Errorf("#%d: start, committed, stabled, applied, lastIndex = %d, %d, %d, %d, %d, want 0, 3, 3, 0, 3",
+				i, l.start, l.committed, l.stabled, l.applied, l.LastIndex())
+		}
+	}
+
+	rd := rawNode.Ready()
+	if err := s.ApplySnapshot(rd.Snapshot); err != nil {
+		t.Fatal(err)
+	}
+	rawNode.Advance(rd)
+	l := rawNode.Raft.RaftLog
+	if l.start != 11 || l.committed != 11 || l.stabled != 11 || l.applied != 11 || l.LastIndex() != 11 {
+		t.Errorf("start, committed, stabled, applied, lastIndex = %d, %d, %d, %d, %d, want 11, 11, 11, 11, 11",
+			l.start, l.committed, l.stabled, l.applied, l.LastIndex())
+	}
+	rd = rawNode.Ready()
+	if rd.HardState.Commit != 11 {
+		t.Errorf("hard state commit = %d, want 11", rd.HardState.Commit)
+	}
+	if len(rd.Messages) != 1 || rd.Messages[0].MsgType != pb.MessageType_MsgAppendResponse || rd.Messages[0].To != 1 ||
+		rd.Messages[0].Reject || rd.Messages[0].Index != 11 {
+		t.Errorf("msgs = %+v, want an ack of 11 to 1", rd.Messages)
+	}
+}
+
+// TestRawNodeVerifyEntries2C ensures that with VerifyEntries a corrupted
+// entry in storage is detected when the node loads its log.
+func TestRawNodeVerifyEntries2C(t *testing.T) {
+	s := NewMemoryStorage()
+	s.Append([]pb.Entry{{Term: 1, Index: 1}, {Term: 1, Index: 2, Data: []byte("foo")}, {Term: 1, Index: 3, Data: []byte("bar")}})
+	s.SetHardState(pb.HardState{Term: 1, Commit: 2})
+
+	// the storage doesn't record checksums yet
+	c := newTestConfig(1, []uint64{1}, 10, 1, s)
+	c.VerifyEntries = true
+	if _, err := NewRawNode(c); !errors.Is(err, ErrNoChecksums) {
+		t.Fatalf("err = %v, want %v", err, ErrNoChecksums)
+	}
+
+	s.EnableChecksums()
+	// a conflicting tail and a compaction keep them aligned with the entries
+	s.Append([]pb.Entry{{Term: 2, Index: 3, Data: []byte("baz")}, {Term: 2, Index: 4}})
+	s.Compact(1)
+	if _, err := NewRawNode(c); err != nil {
+		t.Fatalf("err = %v, want nil on an intact log", err)
+	}
+
+	// flip a byte of the data on "disk"
+	s.ents[2].Data = []byte("bay")
+	if _, err := NewRawNode(c); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("err = %v, want %v", err, ErrChecksumMismatch)
+	}
+
+	// not verified unless asked
+	c.VerifyEntries = false
+	if _, err := NewRawNode(c); err != nil {
+		t.Errorf("err = %v, want nil without verification", err)
+	}
+}
+
+// snapshotBuildingStorage reports the snapshot as temporarily unavailable,
+// like an application generating it in the background.
+type snapshotBuildingStorage struct {
+	*MemoryStorage
+}
+
+func (s snapshotBuildingStorage) Snapshot() (pb.Snapshot, error) {
+	return pb.Snapshot{}, ErrSnapshotTemporarilyUnavailable
+}
+
+// TestRawNodeCompactDuringSnapshot2C tests that compaction is deferred while
+// the application is building a snapshot, and resumes afterward.
+func TestRawNodeCompactDuringSnapshot2C(t *testing.T) {
+	s := NewMemoryStorage()
+	for i := uint64(1); i <= 10; i++ {
+		s.Append([]pb.Entry{{Index: i, Term: 1}})
+	}
+	s.SetHardState(pb.HardState{Term: 1, Commit: 10})
+	rawNode, err := NewRawNode(newTestConfig(1, []uint64{1, 2}, 10, 1, snapshotBuildingStorage{s}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rawNode.Raft
+	r.RaftLog.applied = 10
+	s.Compact(5)
+	r.RaftLog.maybeCompact()
+	if r.RaftLog.start != 5 {
+		t.Fatalf("start = %d, want 5", r.RaftLog.start)
+	}
+	r.becomeCandidate()
+	r.becomeLeader()
+
+	// peer 2 needs compacted entries, the snapshot is still being built
+	r.Prs[2].Next = 3
+	r.sendAppend(2)
+	if !r.RaftLog.snapshotInProgress {
+		t.Fatal("snapshotInProgress = false, want true")
+	}
+	s.Compact(8)
+	rawNode.Advance(rawNode.Ready())
+	if r.RaftLog.start != 5 {
+		t.Errorf("start = %d, want 5 while the snapshot is built", r.RaftLog.start)
+	}
+
+	rawNode.Advance(rawNode.Ready())
+	if r.RaftLog.start != 8 {
+		t.Errorf("start = %d, want 8", r.RaftLog.start)
+	}
+}
+
+type durationObserver struct {
+	steps map[pb.MessageType][]time.Duration
+	ticks []time.Duration
+	ready []time.Duration
+	// number of OnLeaseExpired calls
+	leaseExpired int
+}
+
+func (o *durationObserver) OnStepDuration(t pb.MessageType, d time.Duration) {
+	o.steps[t] = append(o.steps[t], d)
+}
+func (o *durationObserver) OnTickDuration(d time.Duration)  { o.ticks = append(o.ticks, d) }
+func (o *durationObserver) OnReadyDuration(d time.Duration) { o.ready = append(o.ready, d) }
+func (o *durationObserver) OnLeaseExpired()                 { o.leaseExpired++ }
+
+// TestRawNodeObserverDurations2AA ensures the observer is called with the
+// duration of steps, ticks and Ready assembly.
+func TestRawNodeObserverDurations2AA(t *testing.T) {
+	o := &durationObserver{steps: map[pb.MessageType][]time.Duration{}}
+	c := newTestConfig(1, []uint64{1}, 10, 1, NewMemoryStorage())
+	c.Observer = o
+	rawNode, err := NewRawNode(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawNode.Campaign()
+	rawNode.Propose([]byte("foo"))
+	rawNode.Tick()
+	rawNode.Ready()
+
+	for _, mt := range []pb.MessageType{pb.MessageType_MsgHup, pb.MessageType_MsgPropose} {
+		if len(o.steps[mt]) == 0 {
+			t.Errorf("no step duration for %s", mt)
+		}
+	}
+	if len(o.ticks) != 1 || len(o.ready) != 1 {
+		t.Fatalf("ticks, ready = %d, %d, want 1, 1", len(o.ticks), len(o.ready))
+	}
+	for _, ds := range append(append(o.ticks, o.ready...), o.steps[pb.MessageType_MsgPropose]...) {
+		if ds < 0 || ds > time.Second {
+			t.Errorf("duration = %v, want within [0, 1s]", ds)
+		}
+	}
+}
+
+// TestRawNodeLeaseExpired2AA ensures the observer is told when the leader
+// goes an election timeout without hearing from a quorum, and not before.
+func TestRawNodeLeaseExpired2AA(t *testing.T) {
+	o := &durationObserver{steps: map[pb.MessageType][]time.Duration{}}
+	c := newTestConfig(1, []uint64{1, 2, 3}, 10, 1, NewMemoryStorage())
+	c.Observer = o
+	rawNode, err := NewRawNode(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawNode.Raft.becomeCandidate()
+	rawNode.Raft.becomeLeader()
+
+	// 2 answers, with the leader itself that's a quorum
+	for i := 0; i < c.ElectionTick-1; i++ {
+		rawNode.Tick()
+	}
+	rawNode.Step(pb.Message{From: 2, To: 1, Term: 1, MsgType: pb.MessageType_MsgHeartbeatResponse})
+	rawNode.Tick()
+	if o.leaseExpired != 0 {
+		t.Fatalf("leaseExpired = %d, want 0", o.leaseExpired)
+	}
+
+	// partitioned from both followers
+	for i := 0; i < c.ElectionTick-1; i++ {
+		rawNode.Tick()
+	}
+	if o.leaseExpired != 0 {
+		t.Fatalf("leaseExpired = %d before the election timeout, want 0", o.leaseExpired)
+	}
+	rawNode.Tick()
+	if o.leaseExpired != 1 {
+		t.Fatalf("leaseExpired = %d, want 1", o.leaseExpired)
+	}
+	// CheckQuorum is off, the leader stays
+	if rawNode.Raft.State != StateLeader {
+		t.Errorf("state = %v, want %v", rawNode.Raft.State, StateLeader)
+	}
+}
+
+// TestRawNodeStatusLogStats2C ensures Status reports the indexes and the size
+// of the entries held in memory.
+func TestRawNodeStatusLogStats2C(t *testing.T) {
+	s := NewMemoryStorage()
+	s.ApplySnapshot(pb.Snapshot{Metadata: &pb.SnapshotMetadata{Index: 3, Term: 1, ConfState: &pb.ConfState{Nodes: []uint64{1}}}})
+	ents := []pb.Entry{
+		{Term: 1, Index: 4, Data: []byte("a")},
+		{Term: 1, Index: 5, Data: []byte("somedata")},
+		{Term: 2, Index: 6},
+	}
+	s.Append(ents)
+	s.SetHardState(pb.HardState{Term: 2, Commit: 5})
+	c := newTestConfig(1, nil, 10, 1, s)
+	c.Applied = 4
+	rawNode, err := NewRawNode(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size uint64
+	for i := range ents {
+		size += uint64(ents[i].Size())
+	}
+
+	w := RaftLogStats{EntryCount: 3, MemBytes: size, FirstIndex: 4, LastIndex: 6, Committed: 5, Applied: 4, Stabled: 6}
+	if g := rawNode.Status().Log; g != w {
+		t.Errorf("log stats = %+v, want %+v", g, w)
+	}
+}
+
+// TestRawNodeWake2AA tests that waking a quiesced follower resumes the
+// usual tick-driven behavior: it doesn't campaign while the leader is alive,
+// and does a full election timeout after it stops hearing from it.
+func TestRawNodeWake2AA(t *testing.T) {
+	c := newTestConfig(2, []uint64{1, 2}, 10, 1, NewMemoryStorage())
+	c.DeterministicElection = true
+	rawNode, err := NewRawNode(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rawNode.Raft
+	r.becomeFollower(1, 1)
+	r.Vote = 1
+	heartbeat := pb.Message{From: 1, To: 2, Term: 1, MsgType: pb.MessageType_MsgHeartbeat}
+	handle := func() {
+		if rawNode.HasReady() {
+			rawNode.Advance(rawNode.Ready())
+		}
+	}
+
+	rawNode.Step(heartbeat)
+	for i := 0; i < 4; i++ {
+		rawNode.Tick()
+	}
+	handle()
+	if !rawNode.Quiesced() {
+		t.Fatalf("idle follower is not quiesced")
+	}
+
+	rawNode.Wake()
+	if rawNode.Quiesced() {
+		t.Fatalf("woken follower is quiesced")
+	}
+	if r.Term != 1 || r.Vote != 1 || r.Lead != 1 {
+		t.Fatalf("term, vote, lead = %d, %d, %d, want 1, 1, 1", r.Term, r.Vote, r.Lead)
+	}
+	// the timer was re-armed, the ticks before quiescing don't count
+	for i := 0; i < 9; i++ {
+		rawNode.Tick()
+	}
+	if r.State != StateFollower || len(r.msgs) != 0 {
+		t.Fatalf("state = %v, msgs = %v, want a quiet follower", r.State, r.msgs)
+	}
+	rawNode.Step(heartbeat)
+	handle()
+	if !rawNode.Quiesced() {
+		t.Fatalf("follower is not quiesced after hearing from the leader")
+	}
+
+	// the leader is gone
+	rawNode.Wake()
+	for i := 0; i < 10; i++ {
+		rawNode.Tick()
+	}
+	if r.State != StateCandidate || r.Term != 2 {
+		t.Errorf("state, term = %v, %d, want %v, 2", r.State, r.Term, StateCandidate)
+	}
+}
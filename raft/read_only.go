@@ -0,0 +1,77 @@
+package raft
+
+import (
+	"github.com/pingcap-incubator/tinykv/log"
+)
+
+// ReadState provides state for read only query.
+// It's caller's responsibility to call ReadIndex first before getting
+// this state from ready, it's also caller's duty to differentiate if this
+// state is what it requests through RequestCtx, eg. given a unique id as
+// RequestCtx
+type ReadState struct {
+	Index      uint64
+	RequestCtx []byte
+}
+
+// readIndexRequest is a read waiting until the commit index reaches index,
+// the leader's no-op if it arrived before it committed, and until a quorum
+// acked a heartbeat of its round, so the leader knows it still leads.
+type readIndexRequest struct {
+	index uint64
+	ctx   []byte
+	round uint64
+}
+
+// readIndex handles a read-only request on the leader. If the leader has not
+// committed an entry in its term yet, its commit index may be stale, so the
+// read is queued until the no-op commits. Each read starts a new round of
+// heartbeats carrying it in Index, the followers echo it back and the read is
+// released once a quorum acked its round or a later one. An ack for an
+// earlier round was sent before the read and says nothing about it.
+func (r *Raft) readIndex(ctx []byte) error {
+	if r.State != StateLeader {
+		log.Debugf("%s not leader, drop read index", r.info())
+		return ErrProposalDropped
+	}
+	index := r.RaftLog.committed
+	if !r.committedEntryInCurrentTerm() {
+		log.Debugf("%s hold read index until no-op %d committed", r.info(), r.noopIndex)
+		index = r.noopIndex
+	}
+	r.readRound++
+	r.pendingReads = append(r.pendingReads, readIndexRequest{index: index, ctx: ctx, round: r.readRound})
+	r.bckstHeart()
+	r.releasePendingReads()
+	return nil
+}
+
+// readConfirmed reports whether a quorum acked a heartbeat of the round.
+func (r *Raft) readConfirmed(round uint64) bool {
+	var acks int
+	for id, pr := range r.Prs {
+		if id == r.id || pr.ReadRound >= round {
+			acks++
+		}
+	}
+	return acks > len(r.Prs)/2
+}
+
+// releasePendingReads releases the held reads whose no-op has committed and
+// whose round is confirmed, they all read at the current commit index. The
+// rounds only grow along the queue, so it stops at the first one held.
+func (r *Raft) releasePendingReads() {
+	var i int
+	for ; i < len(r.pendingReads); i++ {
+		if rd := r.pendingReads[i]; rd.index > r.RaftLog.committed || !r.readConfirmed(rd.round) {
+			break
+		}
+		r.readStates = append(r.readStates, ReadState{Index: r.RaftLog.committed, RequestCtx: r.pendingReads[i].ctx})
+	}
+	r.pendingReads = r.pendingReads[i:]
+}
+
+func (r *Raft) committedEntryInCurrentTerm() bool {
+	term, err := r.RaftLog.Term(r.RaftLog.committed)
+	return err == nil && term == r.Term
+}
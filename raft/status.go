@@ -0,0 +1,107 @@
+package raft
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	pb "github.com/pingcap-incubator/tinykv/proto/pkg/eraftpb"
+)
+
+// Status contains information about this Raft peer and its view of the system.
+// The Progress is only populated on the leader.
+type Status struct {
+	ID uint64
+
+	pb.HardState
+	SoftState
+
+	Applied  uint64
+	Progress map[uint64]Progress
+
+	LeadTransferee uint64
+
+	Log RaftLogStats
+}
+
+// RaftLogStats describes the entries a RaftLog keeps in memory, to find the
+// groups that hold on to a lot of them, e.g. behind a stuck follower.
+type RaftLogStats struct {
+	// EntryCount is the number of entries in memory, from FirstIndex to
+	// LastIndex.
+	EntryCount int
+	// MemBytes is the encoded size of those entries.
+	MemBytes uint64
+
+	FirstIndex, LastIndex       uint64
+	Committed, Applied, Stabled uint64
+}
+
+// stats returns the RaftLogStats of l. It walks the entries in memory.
+func (l *RaftLog) stats() RaftLogStats {
+	s := RaftLogStats{
+		EntryCount: len(l.entries) - 1,
+		FirstIndex: l.First(),
+		LastIndex:  l.LastIndex(),
+		Committed:  l.committed,
+		Applied:    l.applied,
+		Stabled:    l.stabled,
+	}
+	for i := range l.entries[1:] {
+		s.MemBytes += uint64(l.entries[i+1].Size())
+	}
+	return s
+}
+
+// Status returns the current status of the given group.
+func (rn *RawNode) Status() Status {
+	r := rn.Raft
+	s := Status{
+		ID:             r.id,
+		HardState:      r.hardState(),
+		SoftState:      SoftState{Lead: r.Lead, RaftState: r.State},
+		Applied:        r.RaftLog.applied,
+		LeadTransferee: r.leadTransferee,
+		Log:            r.RaftLog.stats(),
+	}
+	if r.State == StateLeader {
+		s.Progress = rn.GetProgress()
+	}
+	return s
+}
+
+// Describe returns a multi-line report of the state of r, for logs and
+// panics when debugging a wedged group. Use Status to inspect it in code.
+// The peers are listed by ID, their progress is only meaningful on a leader.
+func (r *Raft) Describe() string {
+	var b strings.Builder
+	l := r.RaftLog
+	fmt.Fprintf(&b, "raft %x: %s term %d vote %x lead %x\n", r.id, r.State, r.Term, r.Vote, r.Lead)
+	fmt.Fprintf(&b, "log: first %d last %d commit %d applied %d stabled %d\n",
+		l.First(), l.LastIndex(), l.committed, l.applied, l.stabled)
+	fmt.Fprintf(&b, "pending conf index %d transferee %x\n", r.PendingConfIndex, r.leadTransferee)
+
+	ids := make([]uint64, 0, len(r.Prs))
+	for id := range r.Prs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		pr := r.Prs[id]
+		fmt.Fprintf(&b, "peer %x: match %d next %d commit %d active %v", id, pr.Match, pr.Next, pr.Commit, pr.RecentActive)
+		if pr.Probe {
+			b.WriteString(" probe")
+		}
+		if pr.PendingSnapshot != 0 {
+			fmt.Fprintf(&b, " snapshot %d", pr.PendingSnapshot)
+		}
+		if pr.Inflight {
+			b.WriteString(" inflight")
+		}
+		if pr.ReplicationPaused {
+			b.WriteString(" paused")
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
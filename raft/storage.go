@@ -82,6 +82,9 @@ type MemoryStorage struct {
 	snapshot  pb.Snapshot
 	// ents[i] has raft log position i+snapshot.Metadata.Index
 	ents []pb.Entry
+	// crcs[i] is the checksum of ents[i], nil unless EnableChecksums was
+	// called. The dummy entry has none.
+	crcs []uint32
 }
 
 // NewMemoryStorage creates an empty MemoryStorage.
@@ -184,6 +187,9 @@ func (ms *MemoryStorage) ApplySnapshot(snap pb.Snapshot) error {
 
 	ms.snapshot = snap
 	ms.ents = []pb.Entry{{Term: snap.Metadata.Term, Index: snap.Metadata.Index}}
+	if ms.crcs != nil {
+		ms.crcs = make([]uint32, 1)
+	}
 	return nil
 }
 
@@ -232,6 +238,9 @@ func (ms *MemoryStorage) Compact(compactIndex uint64) error {
 	ents[0].Term = ms.ents[i].Term
 	ents = append(ents, ms.ents[i+1:]...)
 	ms.ents = ents
+	if ms.crcs != nil {
+		ms.crcs = append(make([]uint32, 1, len(ents)), ms.crcs[i+1:]...)
+	}
 	return nil
 }
 
@@ -269,5 +278,40 @@ func (ms *MemoryStorage) Append(entries []pb.Entry) error {
 		log.Panicf("missing log entry [last: %d, append at: %d]",
 			ms.lastIndex(), entries[0].Index)
 	}
+	if ms.crcs != nil {
+		ms.crcs = ms.crcs[:offset]
+		for i := range entries {
+			ms.crcs = append(ms.crcs, entryChecksum(&entries[i]))
+		}
+	}
 	return nil
 }
+
+// EnableChecksums makes the storage record the checksum of every entry, the
+// ones it holds and the ones appended from now on, so it can serve
+// Config.VerifyEntries. It costs a CRC per appended entry.
+func (ms *MemoryStorage) EnableChecksums() {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.crcs = make([]uint32, len(ms.ents))
+	for i := 1; i < len(ms.ents); i++ {
+		ms.crcs[i] = entryChecksum(&ms.ents[i])
+	}
+}
+
+// Checksums implements the ChecksumStorage interface.
+func (ms *MemoryStorage) Checksums(lo, hi uint64) ([]uint32, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	if ms.crcs == nil {
+		return nil, ErrNoChecksums
+	}
+	offset := ms.ents[0].Index
+	if lo <= offset {
+		return nil, ErrCompacted
+	}
+	if hi > ms.lastIndex()+1 {
+		return nil, ErrUnavailable
+	}
+	return append([]uint32{}, ms.crcs[lo-offset:hi-offset]...), nil
+}
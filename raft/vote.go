@@ -72,6 +72,13 @@ func (r *Raft) VoteResult() VoteResult {
 		log.Panicf("v is 0")
 		return VoteWon
 	}
+	if r.quorumFunc != nil {
+		granted := make(map[uint64]bool, len(r.votes))
+		for id, v := range r.votes {
+			granted[id] = v
+		}
+		return r.quorumFunc(append([]uint64{}, servers...), granted)
+	}
 
 	var votedCnt int //vote counts for yes.
 	var missing int